@@ -0,0 +1,185 @@
+// benchmark_test.go: benchmarks for compression and expansion
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package bm
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// benchSizes are the sizes of the inputs (and dictionaries) used in
+// the benchmarks
+var benchSizes = []int{4 << 10, 256 << 10, 4 << 20}
+
+// similar returns a copy of dict with a byte changed every 1000 bytes
+// which gives input that is highly compressible against dict
+func similar(dict []byte) []byte {
+	s := append([]byte{}, dict...)
+	for i := 500; i < len(s); i += 1000 {
+		s[i] ^= 0xff
+	}
+	return s
+}
+
+// benchInputs returns the inputs to be compressed and the dictionary
+// to compress them against for each kind of input
+func benchInputs(size int) (dict []byte, inputs map[string][]byte) {
+	dict = randomBytes(size, 42)
+	inputs = map[string][]byte{
+		"similar": similar(dict),
+		"random":  randomBytes(size, 43),
+	}
+	return
+}
+
+func BenchmarkCompress(b *testing.B) {
+	for _, size := range benchSizes {
+		dict, inputs := benchInputs(size)
+		d := BuildDictionary(dict)
+		for _, kind := range []string{"similar", "random"} {
+			input := inputs[kind]
+			b.Run(fmt.Sprintf("%s/%d", kind, size), func(b *testing.B) {
+				out := new(bytes.Buffer)
+				co := NewCompressor()
+				co.SetDictionary(d)
+				b.SetBytes(int64(len(input)))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					out.Reset()
+					co.Reset(out)
+					co.Write(input)
+					if err := co.Close(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkExpand(b *testing.B) {
+	for _, size := range benchSizes {
+		dict, inputs := benchInputs(size)
+		d := BuildDictionary(dict)
+		for _, kind := range []string{"similar", "random"} {
+			input := inputs[kind]
+			out := new(bytes.Buffer)
+			co := NewCompressor()
+			co.SetWriter(out)
+			co.SetDictionary(d)
+			co.Write(input)
+			if err := co.Close(); err != nil {
+				b.Fatal(err)
+			}
+			compressed := out.Bytes()
+
+			b.Run(fmt.Sprintf("%s/%d", kind, size), func(b *testing.B) {
+				p := make([]byte, 0, len(input))
+				b.SetBytes(int64(len(input)))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					ex := NewExpander(bytes.NewReader(compressed), dict)
+					if _, err := ex.Expand(p); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkSetDictionary(b *testing.B) {
+	for _, size := range benchSizes {
+		dict := randomBytes(size, 42)
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			co := NewCompressor()
+			b.SetBytes(int64(len(dict)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				co.SetDictionary(&Dictionary{Dict: dict})
+			}
+		})
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	input := randomBytes(10<<20, 44)
+	for _, grow := range []bool{false, true} {
+		b.Run(fmt.Sprintf("grow=%t", grow), func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				co := NewCompressor()
+				co.SetWriter(new(bytes.Buffer))
+				if grow {
+					co.Grow(len(input))
+				}
+				for p := input; len(p) > 0; p = p[4096:] {
+					co.Write(p[:4096])
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkBuildDictionaryParallel(b *testing.B) {
+	dict := randomBytes(16<<20, 21)
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.SetBytes(int64(len(dict)))
+			for i := 0; i < b.N; i++ {
+				BuildDictionaryParallel(dict, workers)
+			}
+		})
+	}
+}
+
+func BenchmarkNewCompressor(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		NewCompressor()
+	}
+}
+
+func BenchmarkSecondary(b *testing.B) {
+	dict := randomBytes(64<<20, 45)
+	input := randomBytes(1<<20, 46)
+	for _, on := range []bool{false, true} {
+		d := &Dictionary{Dict: dict, Secondary: on}
+		b.Run(fmt.Sprintf("secondary=%t", on), func(b *testing.B) {
+			co := NewCompressor()
+			co.SetDictionary(d)
+			b.SetBytes(int64(len(input)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				co.CompressAppend(nil, input)
+			}
+		})
+	}
+}
+
+func BenchmarkBackwardExtension(b *testing.B) {
+	dict, inputs := benchInputs(4 << 20)
+	d := BuildDictionary(dict)
+	for _, kind := range []string{"similar", "random"} {
+		input := inputs[kind]
+		for _, on := range []bool{true, false} {
+			b.Run(fmt.Sprintf("%s/backward=%t", kind, on), func(b *testing.B) {
+				co := NewCompressor()
+				co.SetDictionary(d)
+				co.SetBackwardExtension(on)
+				b.SetBytes(int64(len(input)))
+				b.ResetTimer()
+				var o []byte
+				for i := 0; i < b.N; i++ {
+					o, _ = co.CompressAppend(o[:0], input)
+				}
+				b.ReportMetric(float64(len(o))/float64(len(input)), "ratio")
+			})
+		}
+	}
+}
@@ -9,9 +9,17 @@ package bm
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"runtime"
+	"strings"
 )
 
 // The compressor uses the Rabin/Karp algorithm to create fingerprints
@@ -44,22 +52,337 @@ const prime uint32 = 1 << (32 - 8 - 1)
 const clip uint32 = prime - 1 // Used to emulate a % operation when we
 // know that prime is a power of two
 
+// Parameters describes the constants used by the compressor, all of
+// which must match for a dictionary or compressed stream to be used
+// by another implementation
+type Parameters struct {
+	Block uint32 // Size of the blocks that are fingerprinted
+	Radix uint32 // Radix of the Rabin/Karp fingerprint
+	Prime uint32 // Modulus of the fingerprint (a power of two)
+}
+
+// Params returns the parameters used by this package
+func Params() Parameters {
+	return Parameters{Block: block, Radix: radix, Prime: prime}
+}
+
 // A Dictionary contains both the raw data being compressed against
 // and the hash table built using the Rabin/Karp procedure
 type Dictionary struct {
 	Dict []byte // Bytes to compress against
 	H    map[uint32]uint32
 	// Stores the mapping between block checksums and their positions
+
+	// Dictionaries larger than 4 GiB can't store their positions in
+	// H and use H64 instead. Setting Wide forces the use of H64 for
+	// smaller dictionaries. Only one of H and H64 is ever populated.
+
+	Wide bool
+	H64  map[uint32]uint64
+
+	// If MaxEntries is non-zero the hash table built for the
+	// dictionary keeps at most that many blocks.  Once it is full the
+	// oldest block is evicted to make room for each new one, so only
+	// the most recent part of a long dictionary can be matched.
+
+	MaxEntries int
+
+	// If Candidates is greater than one then up to that many positions
+	// are kept for each fingerprint when the hash table is built: the
+	// first in H or H64 and the rest, in order, in Extra.  The
+	// Compressor tries them all and uses the one which gives the
+	// longest match, which can improve compression of repetitive data
+	// at the cost of memory and speed.  Extra is not serialized.
+
+	Candidates int
+	Extra      map[uint32][]uint64
+
+	// If Stride is non-zero and less than the block size then blocks
+	// starting every Stride bytes of Dict are hashed rather than
+	// non-overlapping blocks.  This finds matches that are not
+	// aligned with the blocks of Dict much sooner, at the cost of
+	// block/Stride times as many hash table entries.  Compressing
+	// 256 KiB made of pieces of 60 to 200 bytes taken from a 1 MiB
+	// dictionary, a Stride of 25 reduced the output from 17% to 13% of
+	// the input and a Stride of 10 to 11.5%.  Smaller strides gave no
+	// further improvement.
+
+	Stride int
+
+	// If Secondary is set then when the hash table is built H2 holds,
+	// for each entry of H or H64, its position together with a second,
+	// independent fingerprint of the block.  The Compressor looks
+	// blocks up in H2 instead and checks the second fingerprint before
+	// comparing the block with Dict byte by byte, so that most false
+	// positives are rejected without reading Dict (which for a large
+	// dictionary is usually not in the cache).  This costs an entry in
+	// H2 for every entry in H or H64.  Compressing 1 MiB of random data
+	// against a 64 MiB dictionary, where about one lookup in six is a
+	// false positive, the time spent ruling out false positives fell
+	// from 15% to 9% of the time taken and compression as a whole was
+	// about 8% faster.  The blocks in Extra are always compared in
+	// full.  H2 is not serialized.
+
+	Secondary bool
+	H2        map[uint32]SecondaryEntry
+
+	// Block is the size of the blocks fingerprinted when the hash table
+	// was built, recorded so that a dictionary built for another block
+	// size is rejected rather than silently giving no matches.  It is
+	// zero when not known (a Dictionary made by hand or deserialized),
+	// in which case the hash table is assumed to be for the default.
+
+	Block uint32
+}
+
+// A SecondaryEntry is the position of a block in Dict and its second
+// fingerprint (see Dictionary.Secondary)
+type SecondaryEntry struct {
+	Pos uint64
+	Sum uint32
+}
+
+// maxNarrow is the largest dictionary whose positions fit in H
+const maxNarrow = 1<<32 - 1
+
+// wide returns true if the dictionary positions are stored in H64
+func (d *Dictionary) wide() bool {
+	return d.Wide || d.H64 != nil || uint64(len(d.Dict)) > maxNarrow
+}
+
+// lookup finds the position of the block with fingerprint f
+func (d *Dictionary) lookup(f uint32) (uint64, bool) {
+	if d.H64 != nil {
+		p, ok := d.H64[f]
+		return p, ok
+	}
+	p, ok := d.H[f]
+	return uint64(p), ok
+}
+
+// check verifies that the hash table was built for blocks of size
+// bytes and that every block in it lies inside Dict
+func (d *Dictionary) check(size uint32) error {
+	if d.Block != 0 && d.Block != size && (d.H != nil || d.H64 != nil) {
+		return errorf(ErrDictionaryMismatch, "dictionary built with block size %d, compressor uses %d",
+			d.Block, size)
+	}
+	n := uint64(len(d.Dict))
+	for _, p := range d.H {
+		if uint64(p)+uint64(size) > n {
+			return errorf(ErrDictionaryMismatch, "hash table entry %d exceeds dictionary length %d", p, n)
+		}
+	}
+	for _, p := range d.H64 {
+		if p > n || uint64(size) > n-p {
+			return errorf(ErrDictionaryMismatch, "hash table entry %d exceeds dictionary length %d", p, n)
+		}
+	}
+	for _, x := range d.Extra {
+		for _, p := range x {
+			if p > n || uint64(size) > n-p {
+				return errorf(ErrDictionaryMismatch, "hash table entry %d exceeds dictionary length %d", p, n)
+			}
+		}
+	}
+	return nil
+}
+
+// stride returns the distance between the starts of the blocks of
+// size bytes that are hashed
+func (d *Dictionary) stride(size uint32) uint64 {
+	if d.Stride > 0 && uint32(d.Stride) < size {
+		return uint64(d.Stride)
+	}
+	return uint64(size)
+}
+
+// DictionaryStats describes the coverage and size of a Dictionary's
+// hash table
+type DictionaryStats struct {
+	Blocks       int     // Number of blocks of Dict that are hashed
+	Fingerprints int     // Number of distinct fingerprints stored
+	Collisions   float64 // Fraction of blocks not stored in H or H64
+	Memory       int64   // Estimated bytes used by Dict and the tables
+}
+
+// Approximate number of bytes used by each entry in H, H64 and Extra
+// including the overhead of the map
+const (
+	entrySize32    = 16
+	entrySize64    = 24
+	entrySizeExtra = 48
+)
+
+// Stats returns statistics about the dictionary's hash table.  Blocks
+// that have the same fingerprint as an earlier block (because their
+// contents are the same or because of a hash collision) are not stored
+// and cannot be matched, so a high Collisions fraction means poor
+// coverage of Dict.  Collisions also counts blocks evicted because of
+// MaxEntries.
+func (d *Dictionary) Stats() DictionaryStats {
+	var st DictionaryStats
+	step := d.stride(block)
+	if uint64(len(d.Dict)) > uint64(block) {
+		st.Blocks = int((uint64(len(d.Dict))-1-uint64(block))/step) + 1
+	}
+	st.Fingerprints = len(d.H) + len(d.H64)
+	if st.Blocks > 0 {
+		st.Collisions = float64(st.Blocks-st.Fingerprints) / float64(st.Blocks)
+		if st.Collisions < 0 {
+			st.Collisions = 0
+		}
+	}
+
+	st.Memory = int64(len(d.Dict)) + int64(len(d.H))*entrySize32 +
+		int64(len(d.H64)+len(d.H2))*entrySize64
+	for _, x := range d.Extra {
+		st.Memory += entrySizeExtra + int64(cap(x))*8
+	}
+	return st
+}
+
+// CollisionReport rehashes Dict, independently of the hash table, and
+// returns the number of blocks that are fingerprinted, the number of
+// distinct fingerprints among them (which is how many blocks a hash
+// table without MaxEntries stores) and the number of blocks dropped
+// because an earlier block had the same fingerprint, either because
+// their contents are the same or because of a collision.  A high
+// number dropped for data which doesn't repeat itself means that the
+// fingerprint is saturated and a wider one (see NewCompressorWithHash)
+// would help.  This is for diagnosis only and uses memory proportional
+// to the number of blocks.
+func (d *Dictionary) CollisionReport() (totalBlocks, storedFingerprints, droppedDueToCollision int) {
+	size := block
+	if d.Block != 0 {
+		size = d.Block
+	}
+	seen := make(map[uint32]struct{})
+	blk := uint64(size)
+	step := d.stride(size)
+	h := newRabinKarp(size)
+	for i := uint64(0); i < uint64(len(d.Dict)); i++ {
+		if i < blk {
+			h.Prime(d.Dict[i])
+			continue
+		}
+		if (i-blk)%step == 0 {
+			totalBlocks++
+			seen[h.Sum()] = struct{}{}
+		}
+		h.Roll(d.Dict[i-blk], d.Dict[i])
+	}
+	storedFingerprints = len(seen)
+	droppedDueToCollision = totalBlocks - storedFingerprints
+	return
+}
+
+// Clone returns a deep copy of the dictionary.  A Dictionary passed to
+// SetDictionary is shared with the Compressor rather than copied, so
+// Clone is the safe way to fork one before modifying Dict or the hash
+// table while other goroutines are still using it.
+func (d *Dictionary) Clone() *Dictionary {
+	n := *d
+	if d.Dict != nil {
+		n.Dict = append([]byte{}, d.Dict...)
+	}
+	if d.H != nil {
+		n.H = make(map[uint32]uint32, len(d.H))
+		for k, v := range d.H {
+			n.H[k] = v
+		}
+	}
+	if d.H64 != nil {
+		n.H64 = make(map[uint32]uint64, len(d.H64))
+		for k, v := range d.H64 {
+			n.H64[k] = v
+		}
+	}
+	if d.Extra != nil {
+		n.Extra = make(map[uint32][]uint64, len(d.Extra))
+		for k, v := range d.Extra {
+			n.Extra[k] = append([]uint64{}, v...)
+		}
+	}
+	if d.H2 != nil {
+		n.H2 = make(map[uint32]SecondaryEntry, len(d.H2))
+		for k, v := range d.H2 {
+			n.H2[k] = v
+		}
+	}
+	return &n
+}
+
+// contains checks that a reference to length bytes at start lies
+// inside the dictionary before it is written, so that a bug or a
+// misconfigured Dictionary gives an error when compressing rather
+// than a stream which cannot be expanded.  In self referential mode
+// Dict is the data being compressed.
+func (d *Dictionary) contains(start, length uint64, self bool) error {
+	n := uint64(len(d.Dict))
+	if n == 0 && !self {
+		return errorf(ErrReferenceOutOfBounds, "reference written with an empty dictionary")
+	}
+	if start > n || length > n-start {
+		what := "dictionary"
+		if self {
+			what = "input"
+		}
+		return errorf(ErrReferenceOutOfBounds, "reference [%d,%d) exceeds %s length %d",
+			start, start+length, what, n)
+	}
+	return nil
+}
+
+// add records that the block with fingerprint f is at position p
+// unless the fingerprint has already been seen
+func (d *Dictionary) add(f uint32, p uint64) {
+	if d.H64 != nil {
+		if _, exists := d.H64[f]; !exists {
+			d.H64[f] = p
+		}
+		return
+	}
+	if _, exists := d.H[f]; !exists {
+
+		// A dictionary being built incrementally may grow beyond the
+		// positions that H can hold in which case it is switched over
+		// to H64
+
+		if p > maxNarrow {
+			d.Wide = true
+			d.H64 = make(map[uint32]uint64, len(d.H)+1)
+			for k, v := range d.H {
+				d.H64[k] = uint64(v)
+			}
+			d.H = nil
+			d.H64[f] = p
+			return
+		}
+
+		d.H[f] = uint32(p)
+	}
 }
 
-// A Compressor is a complete instance of the compressor
+// ErrNoWriter is returned by Write and Close if SetWriter has not
+// been called
+var ErrNoWriter = errors.New("compressor has no writer, call SetWriter")
+
+// ErrClosed is returned by Write, Flush and Close if Close has already
+// been called and the Compressor has not been Reset
+var ErrClosed = errors.New("compressor is closed, call Reset")
+
+// A Compressor is a complete instance of the compressor.
+//
+// By default compression is not streaming: everything written to a
+// Compressor is held in memory until Flush or Close is called, so
+// memory use grows with the size of the input (see BufferedBytes).
+// Without a dictionary data is kept even after Flush so that later
+// data can refer to it.  SetWindow bounds the memory used instead.
 type Compressor struct {
-	w io.Writer // The io.Writer where compressed data will be written
-	f uint32    // The current fingerprint as we are processing
-	d []byte    // The data to be compressed.
-	l uint32    // Largest 'digit' in the radix that will be seen in the
-	// fingerprint
-	save [256]uint32
+	w    io.Writer   // The io.Writer where compressed data will be written
+	h    RollingHash // Computes the fingerprint as we are processing
+	d    []byte      // The data to be compressed.
 	dict Dictionary
 
 	// Values that keep track of the size of the data that was written
@@ -67,6 +390,127 @@ type Compressor struct {
 
 	inSize  int
 	outSize int
+
+	// Number of fingerprint matches found in the hash table which were
+	// verified as real matches and those which were hash collisions
+
+	hits           uint64
+	falsePositives uint64
+
+	checksum bool // Set if integrity checksums are written
+	end      bool // Set if Close writes ctrlEnd
+
+	noBackward bool // Set if matches are only extended forwards
+
+	maxInput int // If non-zero the most input accepted for a stream
+
+	prefix    bool         // Set if Close writes the length first
+	prefixBuf bytes.Buffer // The stream while its length is unknown
+
+	// If stored is set the sections written by each part of the
+	// compression are held in heldBuf, and what they cover in held,
+	// until settle knows that they are no longer than the data they
+	// cover (see SetStoredFallback).  holdW, holdPos, holdOut and
+	// holdPrev are w, pos, outSize and prev from before they were
+	// written.
+
+	stored   bool
+	holding  bool
+	held     []heldSection
+	heldBuf  bytes.Buffer
+	holdW    io.Writer
+	holdPos  uint64
+	holdOut  int
+	holdPrev uint64
+
+	// If delta is set reference offsets are written relative to prev,
+	// the end of the previous reference
+
+	delta bool
+	prev  uint64
+
+	id uint32 // If non-zero the dictionary id written (ctrlDictionaryID)
+
+	combined bool // Set if references to earlier input are also made
+	// when there is a dictionary (ctrlCombined)
+
+	minMatch uint64 // Shortest match that will be written as a reference
+
+	minCompress uint64 // Data shorter than this is not compressed
+
+	incomplete bool // Set if CloseContext was cancelled
+
+	// Number of compressed references and uncompressed sections
+	// written by the last compression
+
+	references int
+	literals   int
+
+	// Number of references and literals of each length, kept across
+	// Reset so that their memory is reused
+	refLens map[int]int
+	litLens map[int]int
+
+	// State kept between calls to Flush.  The data in d before start
+	// has already been compressed and written.  In self referential
+	// mode it is kept so that later data can refer to it and local is
+	// the hash table built from it.
+
+	start    uint64
+	local    *Dictionary
+	started  bool   // Set once the start of the stream has been written
+	crc      uint32 // CRC-32 of the data compressed so far
+	summed   uint64 // Position in d up to which crc has been calculated
+	closed   bool   // Set once Close has been called
+	complete bool   // Set once Close has written the end of the stream
+
+	// When compressing as data is written (see SetWindow) the
+	// compression of the data since start is resumed at i with the
+	// positions skip and last from the main loop.  Data is discarded
+	// from the start of d as it is no longer needed and base is the
+	// position in the input of d[0], which is used for positions in
+	// local.  lh limits the size of local to the window.
+
+	window uint64
+	i      uint64
+	skip   uint64
+	last   uint64
+	base   uint64
+	lh     *hasher
+
+	// With SetSpill input beyond the first spill bytes is written to
+	// the temporary file spilled (created in spillDir) and compressed
+	// from there with a window of spill bytes
+
+	spill    uint64
+	spillDir string
+	spilled  *os.File
+
+	// If set section is called for each section written and pos is
+	// the offset in the input of the next section
+
+	section func(kind SectionKind, inputOffset, length int)
+	pos     uint64
+
+	logf func(format string, args ...interface{}) // See SetLogger
+
+	// Scratch space used to encode the varints of a section header
+	// so that writing them does not allocate
+
+	scratch [1 + 2*binary.MaxVarintLen64]byte
+
+	aw  appendWriter // Used by CompressAppend
+	out []byte       // Output buffer reused by Compress
+}
+
+// appendWriter is an io.Writer which appends to a slice
+type appendWriter struct {
+	b []byte
+}
+
+func (w *appendWriter) Write(p []byte) (int, error) {
+	w.b = append(w.b, p...)
+	return len(p), nil
 }
 
 // NewCompressor creates a new compressor.  The Compressor implements
@@ -74,25 +518,18 @@ type Compressor struct {
 // output.  Note that you must call SetWriter and SetDictionary before
 // doing any compression to set the output writer.
 func NewCompressor() *Compressor {
+	return NewCompressorWithHash(newRabinKarp(block))
+}
+
+// NewCompressorWithHash creates a new compressor which fingerprints
+// blocks with h rather than the default Rabin/Karp hash.  Since the
+// hash table of a Dictionary depends on the hash used, dictionaries
+// should be passed to SetDictionary without H so that it is built
+// using h.
+func NewCompressorWithHash(h RollingHash) *Compressor {
 	c := Compressor{}
 	c.w = nil
-	c.f = 0
-
-	// Calculate the largest 'digit' that can be stored in the
-	// fingerprint.  It's radix^(block-1) mod prime.  Calculated in a
-	// loop to avoid an overflow when doing something like 256^100 mod
-	// 16777213.
-
-	c.l = 1
-	var i uint32
-	for i = 0; i < block-1; i++ {
-		c.l *= radix
-		c.l &= clip
-	}
-
-	for i = 0; i < 256; i++ {
-		c.save[i] = i * c.l
-	}
+	c.h = h
 
 	c.inSize = 0
 	c.outSize = 0
@@ -101,43 +538,380 @@ func NewCompressor() *Compressor {
 }
 
 // SetWriter sets the writer to which the compressed output will be written.
-// This must be called otherwise an error will occur.
+// This must be called otherwise Write and Close return ErrNoWriter.
 func (c *Compressor) SetWriter(w io.Writer) {
 	c.w = w
 }
 
+// Reset discards any buffered data and statistics so that the
+// Compressor can be reused, writing to w.  The precomputed tables
+// and the currently loaded dictionary are kept so that compressing
+// after Reset gives the same output as a new Compressor with the same
+// dictionary.
+func (c *Compressor) Reset(w io.Writer) {
+	c.w = w
+	c.h.Reset()
+	c.d = c.d[:0]
+	c.inSize = 0
+	c.outSize = 0
+	c.hits = 0
+	c.falsePositives = 0
+	c.incomplete = false
+	c.references = 0
+	c.literals = 0
+	for l := range c.refLens {
+		delete(c.refLens, l)
+	}
+	for l := range c.litLens {
+		delete(c.litLens, l)
+	}
+	c.start = 0
+	c.local = nil
+	c.started = false
+	c.crc = 0
+	c.summed = 0
+	c.closed = false
+	c.complete = false
+	c.pos = 0
+	c.i = 0
+	c.skip = 0
+	c.last = 0
+	c.base = 0
+	c.lh = nil
+	c.removeSpill()
+}
+
+// SetMinMatch sets the minimum length of a match that will be
+// written as a compressed reference.  Shorter matches are written as
+// uncompressed data instead.  Matches are always at least one block
+// long so values below that have no effect, which is the default.
+// Raising it trades ratio for fewer references, although skipping a
+// short match sometimes lets a longer overlapping match be found
+// instead.
+func (c *Compressor) SetMinMatch(n int) {
+	c.minMatch = uint64(n)
+}
+
+// SetMinCompressSize sets the size below which the data compressed by
+// Close (or Flush) is written as a single uncompressed section without
+// searching for matches at all.  For tiny objects this saves the cost
+// of fingerprinting the data when little or nothing would be gained.
+// Zero, the default, always searches for matches.  It has no effect
+// with SetWindow.
+func (c *Compressor) SetMinCompressSize(n int) {
+	c.minCompress = uint64(n)
+}
+
+// SetChecksum enables or disables integrity checking.  When enabled
+// the compressed output starts with a checksum of the dictionary and
+// ends with a checksum of the uncompressed data which the Expander
+// verifies.  This is off by default to keep the output minimal.
+func (c *Compressor) SetChecksum(on bool) {
+	c.checksum = on
+}
+
+// SetDeltaOffsets enables or disables writing the offset of each
+// reference relative to the end of the previous one.  When matches are
+// clustered in the dictionary (for example input that is an edited
+// copy of part of it) the relative offsets are small and take fewer
+// bytes than the absolute ones.  Streams written this way start with
+// a control section that tells the Expander to decode them, so they
+// cannot be expanded by older versions of this package.  This is off
+// by default.
+func (c *Compressor) SetDeltaOffsets(on bool) {
+	c.delta = on
+}
+
+// SetSelfReferences enables or disables references to earlier parts
+// of the input as well as to the dictionary, which improves the ratio
+// of large objects that repeat themselves.  The offsets of references
+// to the input start after the end of the dictionary.  As without a
+// dictionary the input is kept in memory until Close (or for as long
+// as SetWindow allows), and so is the output by the Expander.  Streams
+// written this way start with a control section that tells the
+// Expander to decode them, so they cannot be expanded by older
+// versions of this package.  This is off by default and has no effect
+// without a dictionary.
+func (c *Compressor) SetSelfReferences(on bool) {
+	c.combined = on
+}
+
+// SetEndMarker enables or disables ending the stream written by Close
+// with a control section that marks its end, so that several streams
+// can be written one after the other to the same file and expanded
+// one at a time with ExpandNext.  An Expander stops at the marker as
+// though the stream had ended there.  It adds 7 bytes to the output,
+// which is written even for no input.  This is off by default.
+func (c *Compressor) SetEndMarker(on bool) {
+	c.end = on
+}
+
+// SetStoredFallback enables or disables making sure that the output
+// is never longer than the input written as a single uncompressed
+// section (a varint of its length followed by the data), apart from
+// any control sections.  Each part of the output is held back until
+// it is known to be no longer than the data it covers, and if it is
+// longer that data is written as part of an uncompressed section
+// instead.  This is the form the Expander already reads, so the
+// stream can be expanded by older versions of this package.  Each
+// Flush starts a new uncompressed section, and with SetWindow (or
+// SetSpill) data which doesn't match is written out once more than
+// the window, and at least 32 KiB, of it is buffered, each adding the
+// length of another uncompressed section (3 bytes for up to 2 MiB).
+// The output held back is kept in memory, which takes up to as much
+// again as the input buffered.  This is off by default.
+func (c *Compressor) SetStoredFallback(on bool) {
+	c.stored = on
+}
+
+// ErrInputTooLarge is returned by Write, WriteString and ReadFrom if
+// the input would exceed the limit set with SetMaxInputSize
+var ErrInputTooLarge = errors.New("input exceeds maximum size")
+
+// SetMaxInputSize limits the total input of a stream to n bytes, so
+// that input of unknown size can't use up all the memory before Close.
+// A Write that would take the input past n returns ErrInputTooLarge
+// and none of it is buffered; the input before it can still be
+// compressed by Close.  ReadFrom stops in the same way once the input
+// would exceed n, discarding the last data read.  Zero, the default,
+// means unlimited.
+func (c *Compressor) SetMaxInputSize(n int) {
+	c.maxInput = n
+}
+
+// tooLarge: returns true if another n bytes of input would exceed the
+// limit set by SetMaxInputSize
+func (c *Compressor) tooLarge(n int) bool {
+	return c.maxInput > 0 && n > c.maxInput-c.inSize
+}
+
+// SetLengthPrefix enables or disables writing the length of the
+// compressed stream before it, which makes it self-delimiting so that
+// several can be concatenated or embedded in other data and expanded
+// with NewLengthPrefixedExpander.  The whole stream is held in memory
+// until Close, which is an error if data has already been written by
+// Flush or SetWindow.  As this changes the format the stream can only
+// be expanded by an Expander which expects the length.  This is off by
+// default.
+func (c *Compressor) SetLengthPrefix(on bool) {
+	c.prefix = on
+}
+
+// SetBackwardExtension enables or disables extending each match
+// backwards (by up to a block) from the block where it was found.
+// Disabled, a match is only extended forwards, which saves comparing
+// the bytes before it but leaves up to a block before each match
+// uncompressed.  Compressing 4 MiB against a 4 MiB dictionary it made
+// no measurable difference to the time taken, while input differing
+// from the dictionary every 1000 bytes compressed to 5.8% of its size
+// rather than 0.9%.  The stream is expanded in the same way either
+// way.  This is on by default.
+func (c *Compressor) SetBackwardExtension(on bool) {
+	c.noBackward = !on
+}
+
+// SetDictionaryID makes the compressed stream start with id to say
+// which dictionary it was compressed against, so that an Expander
+// created with NewExpanderWithRegistry can find the dictionary itself.
+// Zero, the default, means that no id is written.  The id is not
+// checked against the dictionary; use SetChecksum as well for that.
+func (c *Compressor) SetDictionaryID(id uint32) {
+	c.id = id
+}
+
+// SectionKind is the type of a section of the compressed output
+type SectionKind int
+
+const (
+	Literal   SectionKind = iota // Uncompressed data
+	Reference                    // A reference to the dictionary
+)
+
+func (k SectionKind) String() string {
+	switch k {
+	case Literal:
+		return "literal"
+	case Reference:
+		return "reference"
+	}
+	return fmt.Sprintf("SectionKind(%d)", int(k))
+}
+
+// SetSectionCallback sets a function which is called for each section
+// written to the output with the offset and length of the part of the
+// input that the section covers, for example to log how the data was
+// compressed.  Control sections (see SetChecksum) are not reported.
+// Passing nil removes the callback.  The output is not affected.
+func (c *Compressor) SetSectionCallback(f func(kind SectionKind, inputOffset, length int)) {
+	c.section = f
+}
+
+// SetLogger sets a function, such as log.Printf, which is called with
+// a line of explanation at each decision made while compressing: the
+// matches found, how far they were extended, and the ones rejected.
+// This is verbose and intended for finding out why particular data
+// compressed as it did.  Passing nil, the default, removes it.  The
+// output is not affected.
+func (c *Compressor) SetLogger(logf func(format string, args ...interface{})) {
+	c.logf = logf
+}
+
+// streamLookahead is the amount of data kept beyond the position being
+// compressed when compressing as data is written, so that matches can
+// be extended forwards
+const streamLookahead = 32 * 1024
+
+// SetWindow makes the Compressor compress data as it is written rather
+// than buffering it all until Flush or Close, so that the memory used
+// is bounded.  Without a dictionary references can only be made to
+// the last n bytes of input and with one n bounds the length of data
+// without a match that is held before being written.  Either way
+// about n bytes plus 32 KiB (plus the size of each Write) are kept in
+// memory.  Matches which are still being extended when the buffered
+// data runs out are split so compression is a little worse than with
+// everything buffered.  Zero, the default, buffers everything.  This
+// must be called before any data is written.
+//
+// Note that the Expander keeps all its output in memory when
+// decompressing data compressed without a dictionary unless it too is
+// given a window (see Expander.SetWindow).
+func (c *Compressor) SetWindow(n int) {
+	c.window = uint64(n)
+}
+
+// SetSpill bounds the memory used to buffer input which is larger than
+// n bytes, by writing everything after the first n bytes to a
+// temporary file in dir (or the default directory for temporary files
+// if dir is empty) instead.  Flush and Close then read the data back
+// and compress it as data written with SetWindow(n) would be, so the
+// output is the same size as with SetWindow rather than with
+// everything buffered, but the cost of compressing is paid when the
+// data is compressed rather than as it is written.  The file is
+// removed once it has been read, or by Reset.  Zero, the default,
+// never spills.  It has no effect with SetWindow.
+func (c *Compressor) SetSpill(n int, dir string) {
+	c.spill = uint64(n)
+	c.spillDir = dir
+}
+
+// spilling: returns whether written data goes through spillWrite
+func (c *Compressor) spilling() bool {
+	return c.spill > 0 && c.window == 0
+}
+
+// spillWrite: buffers p, writing whatever doesn't fit to the spill
+// file
+func (c *Compressor) spillWrite(p []byte) error {
+	if c.spilled == nil {
+		keep := sub(c.spill, uint64(len(c.d)))
+		if keep > uint64(len(p)) {
+			keep = uint64(len(p))
+		}
+		c.d = append(c.d, p[:keep]...)
+		p = p[keep:]
+		if len(p) == 0 {
+			return nil
+		}
+
+		f, err := ioutil.TempFile(c.spillDir, "bm-spill-")
+		if err != nil {
+			return err
+		}
+		c.spilled = f
+	}
+
+	_, err := c.spilled.Write(p)
+	return err
+}
+
+// unspill: compresses the data in the spill file, which follows d,
+// with the window set to the spill size, leaving the end of it in d
+// to be compressed by flush.  The file is removed.
+func (c *Compressor) unspill(ctx context.Context) error {
+	f := c.spilled
+	c.spilled = nil
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := c.begin(); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if len(c.d) == cap(c.d) {
+			c.d = append(c.d, make([]byte, 32*1024)...)[:len(c.d)]
+		}
+
+		n, err := f.Read(c.d[len(c.d):cap(c.d)])
+		c.d = c.d[:len(c.d)+n]
+		if n > 0 {
+			if serr := c.stream(); serr != nil {
+				return serr
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// removeSpill: discards the spill file if there is one
+func (c *Compressor) removeSpill() {
+	if c.spilled != nil {
+		c.spilled.Close()
+		os.Remove(c.spilled.Name())
+		c.spilled = nil
+	}
+}
+
 // SetDictionary sets a dictionary. When a dictionary has been loaded
 // references are made to the dictionary (rather than internally in
-// the compressed data itself)
-func (c *Compressor) SetDictionary(dict *Dictionary) {
+// the compressed data itself).  Without a dictionary (or with an
+// empty one) references are made to earlier parts of the data.
+//
+// If the hash table has not been computed then it is computed here,
+// use BuildDictionary to compute it in advance.  An error is returned
+// (and the current dictionary kept) if the hash table refers to blocks
+// that are not inside Dict, for example because Dict has been replaced
+// without rebuilding the hash table, or if it was built for a
+// different block size (see Dictionary.Block).  SetDictionary never
+// modifies dict (a missing hash table is built inside the Compressor)
+// and the Compressor only ever reads Dict and H, so a single
+// Dictionary can safely be shared by Compressors running in different
+// goroutines.  Build it with BuildDictionary first so that the hash
+// table is not recomputed by each Compressor.
+func (c *Compressor) SetDictionary(dict *Dictionary) error {
+	if err := dict.check(block); err != nil {
+		return err
+	}
+
 	c.dict.Dict = dict.Dict
+	c.dict.Wide = dict.wide()
+	c.dict.H = dict.H
+	c.dict.H64 = dict.H64
+	c.dict.MaxEntries = dict.MaxEntries
+	c.dict.Candidates = dict.Candidates
+	c.dict.Extra = dict.Extra
+	c.dict.Stride = dict.Stride
+	c.dict.Secondary = dict.Secondary
+	c.dict.H2 = dict.H2
+	c.dict.Block = dict.Block
 
 	// If the dictionary of hashes has not been computed then it must
 	// be computed now
-	if dict.H == nil {
-		c.dict.H = make(map[uint32]uint32)
-
-		f := uint32(0)
-		for ii := range c.dict.Dict {
-			i := uint32(ii)
-
-			if i < block {
-				f = (f*radix + uint32(c.dict.Dict[i])) & clip
-			} else {
-				if i%block == 0 {
-					_, exists := c.dict.H[f]
-					if !exists {
-						c.dict.H[f] = uint32(i - block)
-					}
-				}
-
-				f = (radix*(f-c.save[c.dict.Dict[i-block]]) +
-					uint32(c.dict.Dict[i])) & clip
-			}
-		}
-	} else {
-		c.dict.H = dict.H
+	if dict.H == nil && dict.H64 == nil {
+		c.dict.build(c.h, block)
 	}
+	return nil
 }
 
 // GetDictionary retrieves the dictionary structure for serialization
@@ -147,388 +921,2762 @@ func (c *Compressor) GetDictionary() *Dictionary {
 
 // Write implements the io.Writer interface.  To compress data Write
 // repeatedly and it will be compressed.  When done it is necessary to
-// call Close() where the actual compression occurs.
+// call Close() where the actual compression occurs.  Until then the
+// data is buffered in memory.
 func (c *Compressor) Write(p []byte) (int, error) {
-	c.d = append(c.d, p...)
+	if c.w == nil {
+		return 0, ErrNoWriter
+	}
+	if c.closed {
+		return 0, ErrClosed
+	}
 	n := len(p)
+	if c.tooLarge(n) {
+		return 0, ErrInputTooLarge
+	}
 	c.inSize += n
+	if c.spilling() {
+		return n, c.spillWrite(p)
+	}
+	c.d = append(c.d, p...)
+	if c.window > 0 {
+		return n, c.stream()
+	}
 	return n, nil
 }
 
-// File format:
-//
-// A section of uncompressed data is written with a length value
-// preceding it. The length is a base 128 number (a varint) with the
-// same encoding Google Protocol Buffers uses.
-//
-// A compression section starts with a 0 (since no uncompressed
-// section can have zero length) followed by a pair of varints giving
-// the offset and length of the region to be copied.
+// WriteString is like Write but takes a string, avoiding the copy
+// made when converting it to a []byte.  It implements the
+// io.StringWriter interface.
+func (c *Compressor) WriteString(s string) (int, error) {
+	if c.w == nil {
+		return 0, ErrNoWriter
+	}
+	if c.closed {
+		return 0, ErrClosed
+	}
+	n := len(s)
+	if c.tooLarge(n) {
+		return 0, ErrInputTooLarge
+	}
+	c.inSize += n
+	if c.spilling() {
+		return n, c.spillWrite([]byte(s))
+	}
+	c.d = append(c.d, s...)
+	if c.window > 0 {
+		return n, c.stream()
+	}
+	return n, nil
+}
 
-// writeVarUInt: writes out a variable integer which used base 128
-// in the style of Google Protocol Buffers.
-func (c *Compressor) writeVarUint(u uint32) error {
-	buf := make([]byte, 1)
+// BufferedBytes returns the number of bytes of input currently held
+// in memory by the Compressor.
+func (c *Compressor) BufferedBytes() int {
+	return len(c.d)
+}
 
+// Grow grows the buffer used to hold the data written to the
+// Compressor so that another n bytes can be written without any
+// further allocation.  This is useful when the size of the input is
+// known in advance.  If n is negative Grow will panic.
+func (c *Compressor) Grow(n int) {
+	if n < 0 {
+		panic("bm.Compressor.Grow: negative count")
+	}
+	if cap(c.d)-len(c.d) < n {
+		d := make([]byte, len(c.d), len(c.d)+n)
+		copy(d, c.d)
+		c.d = d
+	}
+}
+
+// ReadFrom implements the io.ReaderFrom interface so that io.Copy
+// reads directly into the buffered input rather than going through
+// Write.  The data buffered is identical to that from calling Write
+// with the same bytes.
+func (c *Compressor) ReadFrom(r io.Reader) (int64, error) {
+	if c.w == nil {
+		return 0, ErrNoWriter
+	}
+	if c.closed {
+		return 0, ErrClosed
+	}
+
+	var total int64
 	for {
-		buf[0] = byte(u & 0x7F)
-		u >>= 7
+		if len(c.d) == cap(c.d) {
+			c.d = append(c.d, make([]byte, 32*1024)...)[:len(c.d)]
+		}
 
-		if u != 0 {
-			buf[0] |= 0x80
+		// With a limit no more than one byte beyond it is read, which
+		// is enough to know that the input is too large
+
+		buf := c.d[len(c.d):cap(c.d)]
+		if c.maxInput > 0 && len(buf) > c.maxInput-c.inSize+1 {
+			buf = buf[:c.maxInput-c.inSize+1]
+		}
+		n, err := r.Read(buf)
+		if c.tooLarge(n) {
+			return total, ErrInputTooLarge
+		}
+		c.d = c.d[:len(c.d)+n]
+		c.inSize += n
+		total += int64(n)
+
+		// The data read is passed on to the spill file as it would
+		// be by Write
+
+		if c.spilling() && (c.spilled != nil || uint64(len(c.d)) > c.spill) {
+			p := c.d[len(c.d)-n:]
+			c.d = c.d[:len(c.d)-n]
+			if serr := c.spillWrite(p); serr != nil {
+				return total, serr
+			}
+		}
+
+		if c.window > 0 && n > 0 {
+			if serr := c.stream(); serr != nil {
+				return total, serr
+			}
+		}
+
+		if err == io.EOF {
+			return total, nil
 		}
-		n, err := c.w.Write(buf)
 		if err != nil {
-			return err
+			return total, err
 		}
-		c.outSize += n
-		if u == 0 {
+	}
+}
+
+// File format:
+//
+// A section of uncompressed data is written with a length value
+// preceding it. The length is a base 128 number (a varint) with the
+// same encoding Google Protocol Buffers uses.
+//
+// A compression section starts with a 0 (referenceMarker, since no
+// uncompressed section can have zero length) followed by a pair of
+// varints giving the offset and length of the region to be copied.
+//
+// A compression section is at most 21 bytes long but always covers at
+// least one block of data, which is more than its own size plus that
+// of the length of the uncompressed section that follows it.  So the
+// output for n bytes of input is never longer than the input written
+// as a single uncompressed section (a varint of n followed by the n
+// bytes) and there is no need for a separate "stored" form for data
+// which doesn't compress.  Control sections and Flush add to this, as
+// do SetWindow and SetSpill, which write a long run of unmatched data
+// as several uncompressed sections and split matches at the end of the
+// data buffered, sometimes into references longer than the data they
+// cover.  SetStoredFallback writes any such part of the stream as
+// uncompressed data instead, so that only the lengths of the extra
+// uncompressed sections are added.
+//
+// Without a dictionary the offset is a position in the output.  A
+// reference may then start in the output already produced and extend
+// beyond its end, in which case the bytes it copies include the ones
+// it has just produced (as in LZ77), so that a short run repeated
+// many times is a single reference.
+//
+// A compression section with a length of zero is never produced for
+// data and is used as a control section: the offset varint gives the
+// type of the control section and is followed by a payload specific
+// to that type.
+//
+// ctrlIntegrity is written at the start of the stream when checksums
+// are enabled with SetChecksum. Its payload is the big endian CRC-32
+// of the dictionary so that the expander can check it is using the
+// same dictionary before any output is produced. It also indicates
+// that the stream ends with a ctrlChecksum section whose payload is
+// the big endian CRC-32 of the uncompressed data.
+//
+// ctrlDelta is written at the start of the stream (after any
+// ctrlIntegrity section) by SetDeltaOffsets. Its payload is zero and
+// it indicates that the offset of every compression section after it
+// is a signed varint (zigzag encoded, as in Protocol Buffers) to be
+// added to the end of the previous compression section, or to zero for
+// the first one.
+//
+// ctrlDictionaryID is written first in the stream by SetDictionaryID.
+// Its payload is the big endian id of the dictionary the stream was
+// compressed against.
+//
+// ctrlCombined is written at the start of the stream (after any
+// ctrlDelta section) by SetSelfReferences. Its payload is zero and it
+// indicates that an offset of at least the length of the dictionary
+// is a position in the output (after subtracting the length of the
+// dictionary) as it would be without a dictionary.
+//
+// ctrlEnd is written last in the stream (after any ctrlChecksum
+// section) by SetEndMarker. Its payload is zero and nothing after it
+// is part of the stream.
+//
+// With SetLengthPrefix the stream is preceded by a varint giving its
+// length in bytes (not counting the varint).  Nothing in the stream
+// says that it is there so it must be expanded by an Expander created
+// with NewLengthPrefixedExpander.
+
+const (
+	ctrlIntegrity    uint64 = 1
+	ctrlChecksum     uint64 = 2
+	ctrlDelta        uint64 = 3
+	ctrlDictionaryID uint64 = 4
+	ctrlCombined     uint64 = 5
+	ctrlEnd          uint64 = 6
+)
+
+// unzigzag: decodes a signed varint already read as an unsigned one
+// into the amount to add to a position
+func unzigzag(u uint64) uint64 {
+	return uint64(int64(u>>1) ^ -int64(u&1))
+}
+
+// referenceMarker is the byte that starts a compression (or control)
+// section.  It is the encoding of a zero length varint, which is what
+// makes it unambiguous: the length of an uncompressed section is never
+// zero, so writeUncompressedBlock must never be called in a way that
+// writes a zero length and referenceMarker must only be written by
+// writeCompressedReference.
+const referenceMarker = 0
+
+// writeVarUInt: writes out a variable integer which used base 128
+// in the style of Google Protocol Buffers.
+func (c *Compressor) writeVarUint(u uint64) error {
+	return c.writeScratch(binary.PutUvarint(c.scratch[:], u))
+}
+
+// writeScratch: writes out the first n bytes of the scratch buffer
+func (c *Compressor) writeScratch(n int) error {
+	n, err := c.w.Write(c.scratch[:n])
+	c.outSize += n
+	return err
+}
+
+// writeUncompressedBlock: writes out a block of uncompressed data
+// preceded by the length of the block as a variable length integer
+func (c *Compressor) writeUncompressedBlock(d []byte) error {
+
+	// An empty block would have a length of zero which the Expander
+	// would read as referenceMarker, so nothing is written
+
+	if len(d) == 0 {
+		return nil
+	}
+	if err := c.writeVarUint(uint64(len(d))); err != nil {
+		return err
+	}
+	if n, err := c.w.Write(d); err != nil {
+		return err
+	} else {
+		c.outSize += n
+	}
+	c.wrote(Literal, uint64(len(d)))
+	return nil
+}
+
+// writeCompressedReference: writes out a block of compressed data
+// which simply consists of a reference to the start of a block to
+// copy and its length.  This is preceded by zero to indicate that
+// this is a block of compressed data
+func (c *Compressor) writeCompressedReference(start, offset uint64) error {
+	c.scratch[0] = referenceMarker
+	n := 1
+	if c.delta && offset > 0 {
+		n += binary.PutVarint(c.scratch[n:], int64(start-c.prev))
+		c.prev = start + offset
+	} else {
+		n += binary.PutUvarint(c.scratch[n:], start)
+	}
+	n += binary.PutUvarint(c.scratch[n:], offset)
+
+	// Control sections are written as references of length zero and
+	// are not counted
+
+	if err := c.writeScratch(n); err != nil {
+		return err
+	}
+	if offset > 0 {
+		c.wrote(Reference, offset)
+	}
+	return nil
+}
+
+// wrote: records that a section covering length bytes of the input
+// has been written, or while sections are held back that it will be
+func (c *Compressor) wrote(kind SectionKind, length uint64) {
+	if c.holding {
+		c.held = append(c.held, heldSection{kind, c.pos, length})
+	} else {
+		c.count(kind, c.pos, length)
+	}
+	c.pos += length
+}
+
+// count: adds a section covering length bytes of the input from pos
+// to the statistics and reports it to the section callback
+func (c *Compressor) count(kind SectionKind, pos, length uint64) {
+	h := &c.litLens
+	if kind == Reference {
+		c.references++
+		h = &c.refLens
+	} else {
+		c.literals++
+	}
+	if *h == nil {
+		*h = make(map[int]int)
+	}
+	(*h)[int(length)]++
+
+	if c.section != nil {
+		c.section(kind, int(pos), int(length))
+	}
+}
+
+// heldSection is a section held back by hold
+type heldSection struct {
+	kind        SectionKind
+	pos, length uint64
+}
+
+// hold: starts holding back the sections written, if SetStoredFallback
+// is on, so that settle can replace them with uncompressed data
+func (c *Compressor) hold() {
+	if !c.stored {
+		return
+	}
+	c.holding = true
+	c.held = c.held[:0]
+	c.heldBuf.Reset()
+	c.holdW, c.holdPos, c.holdOut, c.holdPrev = c.w, c.pos, c.outSize, c.prev
+	c.w = &c.heldBuf
+}
+
+// settle: stops holding back sections and writes them, unless err
+// is set (and returned) or they are longer than the data they cover
+// (plus the length of an uncompressed section if final is set).  The
+// data is then left to be written uncompressed with the data after
+// it, or if final is set written as an uncompressed section now.
+func (c *Compressor) settle(err error, final bool) error {
+	if !c.holding {
+		return err
+	}
+	c.holding = false
+	c.w = c.holdW
+	if err != nil {
+		return err
+	}
+
+	n := c.pos - c.holdPos
+	limit := n
+	if final {
+		limit += uint64(uvarintLen(n))
+	}
+	if uint64(c.heldBuf.Len()) > limit {
+		c.outSize, c.pos, c.prev = c.holdOut, c.holdPos, c.holdPrev
+		if !final {
+			c.last = c.pos - c.base
+			return nil
+		}
+		return c.writeUncompressedBlock(c.d[c.pos-c.base:])
+	}
+
+	c.outSize = c.holdOut
+	m, err := c.w.Write(c.heldBuf.Bytes())
+	c.outSize += m
+	if err != nil {
+		return err
+	}
+	for _, h := range c.held {
+		c.count(h.kind, h.pos, h.length)
+	}
+	return nil
+}
+
+// writeControl: writes out a control section of type code with a
+// CRC-32 payload
+func (c *Compressor) writeControl(code uint64, sum uint32) error {
+	if err := c.writeCompressedReference(code, 0); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(c.scratch[:], sum)
+	return c.writeScratch(4)
+}
+
+// Close tells the compressor that all the data has been written and
+// compresses anything written since the last Flush.  This does not
+// close the underlying io.Writer.  Once Close has been called Write,
+// Flush and Close return ErrClosed until Reset is called to start a
+// new stream.
+func (c *Compressor) Close() error {
+	return c.CloseContext(context.Background())
+}
+
+// CloseVerify is like Close but then expands the compressed output
+// and checks that it is identical to the input, returning an error if
+// it isn't.  This catches a bug in the compressor before the output is
+// relied upon, at the cost of a copy of the output in memory and the
+// time taken to expand it, so it is only done when asked for.  It
+// cannot be used once data has been flushed (by Flush or SetWindow)
+// since the whole stream is needed.
+func (c *Compressor) CloseVerify() error {
+	if c.w == nil {
+		return ErrNoWriter
+	}
+	if c.closed {
+		return ErrClosed
+	}
+	if c.started || c.window > 0 || c.spilled != nil {
+		return errors.New("cannot verify a stream that has been flushed")
+	}
+
+	// Close discards d (in dictionary mode) by truncating it without
+	// overwriting its contents, so input still holds everything
+	// written
+
+	input := c.d
+	w := c.w
+	out := new(bytes.Buffer)
+	c.w = io.MultiWriter(w, out)
+	err := c.Close()
+	c.w = w
+	if err != nil {
+		return err
+	}
+	return c.checkRoundTrip(out.Bytes(), input)
+}
+
+// checkRoundTrip: checks that compressed expands to input
+func (c *Compressor) checkRoundTrip(compressed, input []byte) error {
+	ex := NewExpander(bytes.NewReader(compressed), c.dict.Dict)
+	if c.prefix {
+		ex = NewLengthPrefixedExpander(bytes.NewReader(compressed), c.dict.Dict)
+	}
+	o, err := ex.Expand(make([]byte, 0, len(input)))
+	if err != nil {
+		return fmt.Errorf("verification failed: %w", err)
+	}
+	if !bytes.Equal(o, input) {
+		return errors.New("verification failed: output does not expand to the input")
+	}
+	return nil
+}
+
+// ctxInterval is how often (in bytes of input) CloseContext checks
+// whether its context has been cancelled
+const ctxInterval = 4096
+
+// CloseContext is like Close but stops compressing and returns the
+// context's error if ctx is cancelled before compression is
+// complete.  In that case the output written so far is incomplete,
+// Ratio returns -1 and Reset must be called before the Compressor
+// is used again.
+func (c *Compressor) CloseContext(ctx context.Context) error {
+	if c.w == nil {
+		return ErrNoWriter
+	}
+	if c.closed {
+		return ErrClosed
+	}
+	if c.prefix {
+		return c.closePrefixed(ctx)
+	}
+	return c.close(ctx)
+}
+
+// close: ends the stream
+func (c *Compressor) close(ctx context.Context) error {
+	c.closed = true
+	if err := c.flush(ctx); err != nil {
+		return err
+	}
+
+	if c.checksum {
+		if err := c.writeControl(ctrlChecksum, c.crc); err != nil {
+			return err
+		}
+	}
+	if c.end {
+		if err := c.writeControl(ctrlEnd, 0); err != nil {
+			return err
+		}
+	}
+
+	c.complete = true
+	return nil
+}
+
+// closePrefixed: ends the stream into prefixBuf and then writes it
+// preceded by its length
+func (c *Compressor) closePrefixed(ctx context.Context) error {
+	if c.started {
+		return errors.New("cannot prefix the length of a stream that has been flushed")
+	}
+
+	w := c.w
+	c.prefixBuf.Reset()
+	c.w = &c.prefixBuf
+	err := c.close(ctx)
+	c.w = w
+	if err == nil {
+		err = c.writeVarUint(uint64(c.prefixBuf.Len()))
+	}
+	if err == nil {
+		_, err = c.w.Write(c.prefixBuf.Bytes())
+	}
+	if err != nil {
+		c.complete = false
+	}
+	return err
+}
+
+// CanRoundTrip reports whether the stream written by the last Close is
+// structurally valid: Close succeeded and the sections written cover
+// exactly the input.  References are checked against the dictionary
+// (or the input) as they are written and an uncompressed section is
+// never empty, so together these catch the likely ways for the output
+// to be corrupt cheaply enough to always check.  CloseVerify is the
+// thorough but expensive check.
+func (c *Compressor) CanRoundTrip() bool {
+	return c.complete && c.pos == uint64(c.inSize)
+}
+
+// Flush compresses and writes all the data written to the Compressor
+// so far without ending the stream, so that more data can be written
+// before Close is called.  Any data after the last match is written
+// uncompressed and only the data following the flush can be compressed
+// by later matches, so flushing too often hurts the compression ratio.
+func (c *Compressor) Flush() error {
+	if c.w == nil {
+		return ErrNoWriter
+	}
+	if c.closed {
+		return ErrClosed
+	}
+
+	return c.flush(context.Background())
+}
+
+// flush: compresses the data written since the last flush, starting
+// the stream first if this is the first flush since it was Reset
+func (c *Compressor) flush(ctx context.Context) error {
+	if c.spilled != nil {
+		c.window = c.spill
+		defer func() { c.window = 0 }()
+		if err := c.unspill(ctx); err != nil {
+			if err == ctx.Err() {
+				c.incomplete = true
+			}
+			return err
+		}
+	}
+
+	if err := c.begin(); err != nil {
+		return err
+	}
+
+	c.hold()
+	if err := c.settle(c.compress(ctx, true), true); err != nil {
+		if err == ctx.Err() {
+			c.incomplete = true
+		}
+		return err
+	}
+
+	n := uint64(len(c.d))
+	c.crc = crc32.Update(c.crc, crc32.IEEETable, c.d[c.summed:])
+	c.summed = n
+
+	// Without a dictionary (or with SetSelfReferences) the data is
+	// kept so that later data can refer to it (or as much of it as
+	// fits in the window), otherwise it is no longer needed
+
+	switch {
+	case c.local == nil:
+		c.trim(n)
+	case c.window > 0 && n > c.window:
+		c.trim(n - c.window)
+	}
+
+	return nil
+}
+
+// begin: starts the stream if nothing has been written since the
+// Compressor was Reset
+func (c *Compressor) begin() error {
+	if c.started {
+		return nil
+	}
+
+	c.started = true
+	c.hits = 0
+	c.falsePositives = 0
+	c.incomplete = false
+	c.references = 0
+	c.literals = 0
+	for l := range c.refLens {
+		delete(c.refLens, l)
+	}
+	for l := range c.litLens {
+		delete(c.litLens, l)
+	}
+	c.crc = 0
+	c.pos = 0
+	c.prev = 0
+
+	if c.id != 0 {
+		if err := c.writeControl(ctrlDictionaryID, c.id); err != nil {
+			return err
+		}
+	}
+	if c.checksum {
+		err := c.writeControl(ctrlIntegrity, crc32.ChecksumIEEE(c.dict.Dict))
+		if err != nil {
+			return err
+		}
+	}
+	if c.delta {
+		if err := c.writeControl(ctrlDelta, 0); err != nil {
+			return err
+		}
+	}
+	if c.combined && len(c.dict.Dict) > 0 {
+		return c.writeControl(ctrlCombined, 0)
+	}
+	return nil
+}
+
+// trim: discards the first cut bytes of d which have been compressed
+// and are no longer needed
+func (c *Compressor) trim(cut uint64) {
+	if c.summed < cut {
+		c.crc = crc32.Update(c.crc, crc32.IEEETable, c.d[c.summed:cut])
+		c.summed = cut
+	}
+
+	n := copy(c.d, c.d[cut:])
+	c.d = c.d[:n]
+	c.base += cut
+	c.i -= cut
+	c.last -= cut
+	c.summed -= cut
+
+	// Once the first block has been hashed start is only needed to
+	// know that, and skip may be before the data kept
+
+	c.start = sub(c.start, cut)
+	c.skip = sub(c.skip, cut)
+}
+
+// sub: returns a-b or zero if b is larger
+func sub(a, b uint64) uint64 {
+	if a > b {
+		return a - b
+	}
+	return 0
+}
+
+// stream: compresses as much of the buffered data as can be done
+// before more is written and discards whatever is no longer needed
+func (c *Compressor) stream() error {
+	if err := c.begin(); err != nil {
+		return err
+	}
+	c.hold()
+	if err := c.settle(c.compress(context.Background(), false), false); err != nil {
+		return err
+	}
+
+	// A long run of data without a match is written out (leaving
+	// enough for a match to extend backwards) so that it doesn't have
+	// to be kept.  With SetStoredFallback the run is at least
+	// streamLookahead long so that the length of each adds little.
+
+	blk := uint64(block)
+	run := c.window
+	if c.stored && run < streamLookahead {
+		run = streamLookahead
+	}
+	if c.i >= c.last+2*blk+run {
+		if err := c.writeUncompressedBlock(c.d[c.last : c.i-2*blk]); err != nil {
+			return err
+		}
+		c.last = c.i - 2*blk
+	}
+
+	// The data from last (which hasn't been written yet) and the
+	// block being rolled is still needed, and without a dictionary so
+	// is the window before i.  This is only done when at least half
+	// of d can be discarded so that the copying is amortized.
+
+	keep := c.last
+	if c.i >= c.start+blk && c.i-blk < keep {
+		keep = c.i - blk
+	}
+	if c.local != nil {
+		if c.i < c.window {
+			keep = 0
+		} else if c.i-c.window < keep {
+			keep = c.i - c.window
+		}
+	}
+	if keep > uint64(len(c.d))/2 {
+		c.trim(keep)
+	}
+	return nil
+}
+
+// compress: compresses and writes d[start:].  This is where the
+// Bentley/McIlroy and Rabin/Karp algorithms are implemented.
+// Reference those papers for a full explanation.
+//
+// Unless final is set, compression stops streamLookahead bytes before
+// the end of d so that matches can be extended forwards and resumes
+// from there on the next call.
+func (c *Compressor) compress(ctx context.Context, final bool) error {
+	if c.i == c.start {
+		c.h.Reset()
+		c.skip = c.start
+		c.last = c.start
+	}
+	skip := c.skip
+	last := c.last
+
+	// Positions are calculated using 64-bit arithmetic so that both
+	// the input and the dictionary can exceed 4 GiB
+
+	blk := uint64(block)
+
+	// This points to the slice containing the buffer used as the
+	// dictionary for the compression.  This is either the data itself
+	// (for self referential compression) or its the dictionary set by
+	// SetDictionary
+	//
+	// When there is no dictionary the compression is self referential
+	// and the hash table is built as the data is processed so that
+	// references can be made to earlier parts of the data.  Since the
+	// expander resolves these references from the data it has already
+	// output, the references written never overlap the data that
+	// they are used to produce (although the expander can resolve
+	// ones that do).
+	//
+	// The positions in the hash table built in that case are positions
+	// in the input, which are offset by base from positions in d
+	//
+	// With SetSelfReferences the same hash table is built alongside
+	// the dictionary (both) and whichever gives the longer match is
+	// used
+
+	dict := &c.dict
+	self := len(c.dict.Dict) == 0
+	both := c.combined && !self
+	if self || both {
+		if c.local == nil {
+			c.local = &Dictionary{H: make(map[uint32]uint32)}
+			if c.window > 0 {
+				c.local.MaxEntries = int(c.window/blk) + 1
+				c.lh = &hasher{d: c.local}
+			}
+		}
+		c.local.Dict = c.d
+	}
+	if self {
+		dict = c.local
+	}
+
+	// The loop runs one past the end of the data so that the block
+	// which ends at the end of the data is also checked for a match
+
+	// Data shorter than a block cannot contain a match (and in self
+	// referential mode has no block to add to the hash table), so it
+	// is written as it is, which for no data is nothing at all
+
+	n := uint64(len(c.d))
+	if final && c.window == 0 && (n-c.start < c.minCompress || n-c.start < blk) {
+		if c.logf != nil {
+			c.logf("bm: %d bytes at input offset %d written without searching for matches",
+				n-c.start, c.base+c.start)
+		}
+		p := c.d[c.start:]
+		c.start, c.i, c.skip, c.last = n, n, n, n
+		return c.writeUncompressedBlock(p)
+	}
+
+	end := n + 1
+	if !final {
+		end = 0
+		if n > streamLookahead {
+			end = n - streamLookahead
+		}
+	}
+
+	i := c.i
+	for ; i < end; i++ {
+		if i%ctxInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		// The first block bytes are consumed to calculate the
+		// fingerprint of the first block
+
+		if i < c.start+blk {
+			if i < n {
+				c.h.Prime(c.d[i])
+			}
+		} else {
+
+			// The data is broken up into non-overlapping blocks of
+			// size block.  The fingerprints of each block are stored
+			// in a hash table which keeps the position the first time
+			// the block was seen.
+			//
+			// The fingerprint of the current block which covers the
+			// block bytes (i-block,i] is calculated efficiently by
+			// rolling the hash (see hash.go)
+
+			if i >= skip {
+
+				// If the new fingerprint appears in the hash table
+				// then this block has been seen before and can be
+				// encoded rather than emitted.  First must check that
+				// it's an actual match since there is a small
+				// probability of the hashing algorithm used for
+				// calculating fingerprints having a collision
+
+				sum := c.h.Sum()
+				e, s, f, exists, match := c.find(dict, sum, i, last, self)
+				internal := self
+				if both {
+					le, ls, lf, lexists, lmatch := c.find(c.local, sum, i, last, true)
+					exists = exists || lexists
+					if lmatch && (!match || ls+lf > s+f) {
+						e, s, f, match, internal = le, ls, lf, true, true
+					}
+				}
+
+				if exists {
+					if match {
+						c.hits++
+					} else {
+						c.falsePositives++
+						if c.logf != nil {
+							c.logf("bm: false positive for fingerprint %06x of block at input offset %d",
+								sum, c.base+i-blk)
+						}
+					}
+				}
+
+				if c.logf != nil && match {
+					what, at := "dictionary", e
+					if internal {
+						what, at = "input", c.base+e
+					}
+					c.logf("bm: block at input offset %d matches %s offset %d, extended backward %d and forward %d to %d bytes",
+						c.base+i-blk, what, at, s, f, blk+s+f)
+					if blk+s+f < c.minMatch {
+						c.logf("bm: match of %d bytes is shorter than the minimum %d", blk+s+f, c.minMatch)
+					}
+				}
+
+				// Matches shorter than the minimum are left to be
+				// emitted as part of an uncompressed block
+
+				if match && blk+s+f >= c.minMatch {
+					src := dict
+					if internal {
+						src = c.local
+					}
+					if err := src.contains(e-s, blk+s+f, internal); err != nil {
+						return err
+					}
+					if err := c.writeUncompressedBlock(c.d[last : i-blk-s]); err != nil {
+						return err
+					}
+					ref := e - s
+					if internal {
+						ref += c.base
+					}
+					if internal && both {
+						ref += uint64(len(c.dict.Dict))
+					}
+					if err := c.writeCompressedReference(ref, blk+s+f); err != nil {
+						return err
+					}
+
+					// The match ends at i+f and the next block to be
+					// checked is the one starting there, so that a
+					// match immediately following this one is found
+
+					skip = i + f + blk
+					last = i + f
+				}
+			}
+
+			// In self referential mode the fingerprint of each block
+			// is stored as it is passed so that later data can refer
+			// to it
+
+			if (self || both) && (c.base+i)%blk == 0 {
+				if c.lh != nil {
+					c.lh.add(c.h.Sum(), c.base+i-blk)
+				} else {
+					c.local.add(c.h.Sum(), c.base+i-blk)
+				}
+			}
+
+			if i < n {
+				c.h.Roll(c.d[i-blk], c.d[i])
+			}
+		}
+	}
+
+	if !final {
+		c.i, c.skip, c.last = i, skip, last
+		return nil
+	}
+
+	// The next part of the stream starts after the data compressed
+
+	c.start, c.i, c.skip, c.last = n, n, n, n
+	if last < n {
+		return c.writeUncompressedBlock(c.d[last:])
+	}
+
+	return nil
+}
+
+// find: looks up the fingerprint sum of the block of data ending at
+// i in dict and returns the position e of the longest match found,
+// extended backwards by s bytes and forwards by f bytes.  exists is
+// set if dict has a valid entry for sum, even if it doesn't match.
+// When self is set dict is the hash table of the input and its
+// positions are offset by base.
+func (c *Compressor) find(dict *Dictionary, sum uint32, i, last uint64, self bool) (e, s, f uint64, exists, match bool) {
+	var reject bool
+	if dict.H2 != nil {
+		var x SecondaryEntry
+		x, exists = dict.H2[sum]
+		e = x.Pos
+		reject = exists && x.Sum != secondary(c.d[i-uint64(block):i])
+	} else {
+		e, exists = dict.lookup(sum)
+	}
+	if exists && self {
+		if e < c.base {
+			exists = false
+		}
+		e -= c.base
+	}
+	if exists {
+		exists, match = c.verify(dict, e, i, self, reject)
+	}
+
+	// If there's a match then we need to figure out how far we can
+	// extend it backwards up to block-1 bytes and forward as far as
+	// possible
+
+	if match {
+		s, f = c.extend(dict, e, i, last, self)
+	}
+
+	// When the dictionary keeps several positions for each
+	// fingerprint the one giving the longest match is used
+
+	for _, x := range dict.Extra[sum] {
+		ok, m := c.verify(dict, x, i, self, false)
+		exists = exists || ok
+		if !m {
+			continue
+		}
+		xs, xf := c.extend(dict, x, i, last, self)
+		if !match || xs+xf > s+f {
+			e, s, f, match = x, xs, xf, true
+		}
+	}
+	return
+}
+
+// verify: checks whether the block of the dictionary at e can be
+// used for the block of data ending at i, returning whether e is a
+// valid position and whether the block really matches.  If reject is
+// set the block is already known not to match.
+func (c *Compressor) verify(dict *Dictionary, e, i uint64, self, reject bool) (valid, match bool) {
+	blk := uint64(block)
+
+	// An entry outside the dictionary cannot be a match, SetDictionary
+	// rejects these but the Dictionary may have been changed since
+
+	n := uint64(len(dict.Dict))
+	if e > n || blk > n-e {
+		return false, false
+	}
+	if self && e+blk > i-blk {
+		return false, false
+	}
+
+	// Older input may still be in the hash table and in d but is
+	// outside the window, which the Expander may not have kept
+
+	if self && c.window > 0 && i-blk-e > c.window {
+		return false, false
+	}
+	if reject {
+		return true, false
+	}
+
+	for j := uint64(0); j < blk; j++ {
+		if dict.Dict[e+j] != c.d[i-blk+j] {
+			return true, false
+		}
+	}
+	return true, true
+}
+
+// extend: finds how far the match between the block of the dictionary
+// at e and the block of data ending at i extends backwards (s bytes,
+// not before last) and forwards (f bytes)
+func (c *Compressor) extend(dict *Dictionary, e, i, last uint64, self bool) (s, f uint64) {
+	blk := uint64(block)
+
+	for s = 1; s < blk && !c.noBackward; s++ {
+		if i < last+blk+s {
+			break
+		}
+
+		if e < s {
+			break
+		}
+
+		if i < blk+s {
+			break
+		}
+
+		if self && e+blk > i-blk-s {
+			break
+		}
+
+		if dict.Dict[e-s] != c.d[i-blk-s] {
+			break
+		}
+	}
+	s--
+
+	for f = 0; f < uint64(len(c.d))-i; f++ {
+		if e+blk+f >= uint64(len(dict.Dict)) {
+			break
+		}
+
+		if self && e+blk+f >= i-blk-s {
+			break
+		}
+
+		if dict.Dict[e+blk+f] != c.d[i+f] {
+			break
+		}
+	}
+	return
+}
+
+// Ratio retrieves the compression ratio of the last compression
+// performed. Only makes sense after Close() has been called. The
+// returned value is an integer representing the size of the output as
+// a percentage of the input * 100. If the return value is -1 then it
+// indicates that there was no input (or that compression was
+// cancelled).
+func (c *Compressor) Ratio() int {
+	if c.inSize > 0 && !c.incomplete {
+		return ratio(c.outSize, c.inSize)
+	}
+	return -1
+}
+
+// RatioFloat is like Ratio but returns the size of the output as a
+// fraction of the input without rounding, or -1 in the same cases as
+// Ratio.
+func (c *Compressor) RatioFloat() float64 {
+	if c.inSize > 0 && !c.incomplete {
+		return float64(c.outSize) / float64(c.inSize)
+	}
+	return -1
+}
+
+// ratio: returns 10000 * out / in rounded down, calculated with 128
+// bits so that it cannot overflow however large out is
+func ratio(out, in int) int {
+	hi, lo := bits.Mul64(uint64(out), 10000)
+	if hi >= uint64(in) {
+		return maxInt
+	}
+	q, _ := bits.Div64(hi, lo, uint64(in))
+	if q > uint64(maxInt) {
+		return maxInt
+	}
+	return int(q)
+}
+
+// EffectiveRatio is like Ratio but adds dictShare bytes to the size of
+// the output to account for the cost of shipping the dictionary.  If
+// a dictionary of D bytes is sent once and used for N objects then
+// dictShare would be D/N, and the value returned is
+//
+//	10000 * (CompressedSize() + dictShare) / InputSize()
+//
+// which can be compared fairly with compressors that don't use a
+// shared dictionary.  Returns -1 in the same cases as Ratio.
+func (c *Compressor) EffectiveRatio(dictShare int) int {
+	if c.inSize > 0 && !c.incomplete {
+		return ratio(c.outSize+dictShare, c.inSize)
+	}
+	return -1
+}
+
+// MatchStats returns the number of hash table hits found during the
+// last compression that were verified as real matches and the number
+// that were rejected as fingerprint collisions. Only makes sense after
+// Close() has been called.
+func (c *Compressor) MatchStats() (hits, falsePositives uint64) {
+	return c.hits, c.falsePositives
+}
+
+// Structure returns the number of compressed references and
+// uncompressed (literal) sections written by the last compression.
+// Only makes sense after Close() has been called.
+func (c *Compressor) Structure() (references, literals int) {
+	return c.references, c.literals
+}
+
+// LengthHistograms returns the number of references and of
+// uncompressed (literal) sections of each length written by the last
+// compression, keyed by length in bytes of the input covered.  This
+// shows whether raising SetMinMatch (or changing the block size) would
+// help.  Only makes sense after Close() has been called.  The maps
+// are cleared and reused by the next compression (so that counting
+// does not allocate), copy them to keep them.
+func (c *Compressor) LengthHistograms() (refLens, litLens map[int]int) {
+	return c.refLens, c.litLens
+}
+
+// Get the size in bytes of the last compressed output. Only makes
+// sense after Close() has been called.
+func (c *Compressor) CompressedSize() int {
+	return c.outSize
+}
+
+// Get the size in bytes of the last uncompressed input. Only makes
+// sense after Close() has been called.
+func (c *Compressor) InputSize() int {
+	return c.inSize
+}
+
+// CompressionMetrics gathers the statistics about a compression that
+// are available from the individual accessor methods of the
+// Compressor.  Ratio is the size of the output as a fraction of the
+// input and RatioInt is the value returned by Compressor.Ratio.
+type CompressionMetrics struct {
+	InputSize      int
+	OutputSize     int
+	Ratio          float64
+	RatioInt       int
+	References     int
+	Literals       int
+	Hits           uint64
+	FalsePositives uint64
+}
+
+// Metrics returns the statistics of the last compression.  It only
+// copies fields of the Compressor so it is cheap to call.  Every field
+// is zero until Close has been called.
+func (c *Compressor) Metrics() CompressionMetrics {
+	if !c.closed {
+		return CompressionMetrics{}
+	}
+
+	m := CompressionMetrics{
+		InputSize:      c.inSize,
+		OutputSize:     c.outSize,
+		RatioInt:       c.Ratio(),
+		References:     c.references,
+		Literals:       c.literals,
+		Hits:           c.hits,
+		FalsePositives: c.falsePositives,
+	}
+	if m.RatioInt != -1 {
+		m.Ratio = c.RatioFloat()
+	}
+	return m
+}
+
+// NewWriteCloser returns an io.WriteCloser which compresses everything
+// written to it against dict (or against itself if dict is nil) and
+// writes the result to w.  Unlike Compressor.Close, its Close takes
+// ownership of w: after compressing and writing the data it closes w
+// if w is an io.Closer, even if compression failed.  Errors from
+// SetDictionary are returned by Write and Close.
+func NewWriteCloser(w io.Writer, dict *Dictionary) io.WriteCloser {
+	wc := &writeCloser{c: NewCompressor(), w: w}
+	wc.c.SetWriter(w)
+	if dict != nil {
+		wc.err = wc.c.SetDictionary(dict)
+	}
+	return wc
+}
+
+// writeCloser is the io.WriteCloser returned by NewWriteCloser
+type writeCloser struct {
+	c   *Compressor
+	w   io.Writer
+	err error // Set if the dictionary could not be used
+}
+
+func (wc *writeCloser) Write(p []byte) (int, error) {
+	if wc.err != nil {
+		return 0, wc.err
+	}
+	return wc.c.Write(p)
+}
+
+func (wc *writeCloser) Close() error {
+	err := wc.err
+	if err == nil {
+		err = wc.c.Close()
+	}
+	if cl, ok := wc.w.(io.Closer); ok {
+		if cerr := cl.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Compress compresses data against dict (or against itself if dict
+// is nil) and writes the result to w, returning the compression ratio
+// as given by Ratio.  Use a Compressor directly to compress a stream
+// or to reuse a dictionary without rebuilding its hash table.
+func Compress(w io.Writer, data []byte, dict *Dictionary) (ratio int, err error) {
+	c := NewCompressor()
+	c.SetWriter(w)
+	if dict != nil {
+		if err = c.SetDictionary(dict); err != nil {
+			return -1, err
+		}
+	}
+	if _, err = c.Write(data); err == nil {
+		err = c.Close()
+	}
+	if err != nil {
+		return -1, err
+	}
+	return c.Ratio(), nil
+}
+
+// CompressStream is like Compress but reads the data to compress from
+// r until io.EOF.  It returns the number of bytes of compressed output
+// written to w.
+func CompressStream(w io.Writer, r io.Reader, dict *Dictionary) (int, error) {
+	c := NewCompressor()
+	c.SetWriter(w)
+	if dict != nil {
+		if err := c.SetDictionary(dict); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := c.ReadFrom(r); err != nil {
+		return 0, err
+	}
+	err := c.Close()
+	return c.CompressedSize(), err
+}
+
+// CompressAppend compresses src against the current dictionary (with
+// the current options) and appends the compressed stream to dst,
+// returning the extended slice.  The Compressor is Reset first, so
+// anything buffered is discarded, and afterwards it has no writer.  If
+// dst has enough spare capacity for the output and Grow has been
+// called for the size of src nothing is allocated.  On error dst is
+// returned unchanged with the error.
+func (c *Compressor) CompressAppend(dst, src []byte) ([]byte, error) {
+	c.aw.b = dst
+	c.Reset(&c.aw)
+	_, err := c.Write(src)
+	if err == nil {
+		err = c.Close()
+	}
+	out := c.aw.b
+	c.aw.b = nil
+	c.w = nil
+	if err != nil {
+		return dst, err
+	}
+	return out, nil
+}
+
+// Compress compresses src against the current dictionary (with the
+// current options) and returns the compressed stream in a new slice
+// of exactly its size.  The output is built in a buffer kept by the
+// Compressor, so that after the first call the only allocation is the
+// slice returned.  As with CompressAppend the Compressor is Reset
+// first and afterwards has no writer.
+func (c *Compressor) Compress(src []byte) ([]byte, error) {
+	out, err := c.CompressAppend(c.out[:0], src)
+	if err != nil {
+		return nil, err
+	}
+	c.out = out
+	o := make([]byte, len(out))
+	copy(o, out)
+	return o, nil
+}
+
+// EstimateCoverage returns an estimate, between 0 and 1, of the
+// fraction of data that would be compressed into references to d.  It
+// rolls the fingerprint over data and counts the blocks whose
+// fingerprint is in the hash table, without checking the bytes or
+// extending the matches, so it is much cheaper than compressing data
+// but only approximate: a fingerprint can be a false positive, and a
+// match extends beyond the block found.  If the hash table of d has
+// not been built it is built here (without modifying d).
+func EstimateCoverage(data []byte, d *Dictionary) float64 {
+	blk := uint64(block)
+	n := uint64(len(data))
+	if n < blk || len(d.Dict) == 0 {
+		return 0
+	}
+	if d.H == nil && d.H64 == nil {
+		b := *d
+		b.build(newRabinKarp(block), block)
+		d = &b
+	}
+
+	// Blocks found do not overlap, as with the references that the
+	// Compressor would write for them
+
+	h := newRabinKarp(block)
+	var covered, next uint64
+	for i := uint64(0); i < n; i++ {
+		if i < blk {
+			h.Prime(data[i])
+			continue
+		}
+		if i >= next {
+			if _, ok := d.lookup(h.Sum()); ok {
+				covered += blk
+				next = i + blk
+			}
+		}
+		h.Roll(data[i-blk], data[i])
+	}
+	if _, ok := d.lookup(h.Sum()); ok && n >= next {
+		covered += blk
+	}
+
+	return float64(covered) / float64(n)
+}
+
+// Serialized format:
+//
+// The original serialized form of H is simply a sequence of little
+// endian uint32 pairs (fingerprint then position) with no header.
+//
+// Dictionaries using 64-bit positions are serialized with a four
+// byte header consisting of dictMagic followed by a version byte and
+// then little endian pairs of a uint32 fingerprint and a uint64
+// position. Fingerprints are always less than prime and so the fourth
+// byte of a headerless dictionary is always zero which means that the
+// header cannot be confused with the start of an old dictionary.
+//
+// The numbers are always little endian unless another byte order is
+// chosen with SerializeDictionaryOrder, except in the full format
+// (SerializeFullDictionary) which is always little endian.
+
+const dictMagic = "BMD"
+
+const (
+	dictVersion64   byte = 2 // H64 with 64-bit positions
+	dictVersionFull byte = 3 // Dict and its hash table
+)
+
+// SerializeDictionary turns H (the map part of the Dictionary) into a
+// []byte for easy storage in memcached or elsewhere. If the
+// dictionary uses 64-bit positions then H64 is serialized in the
+// versioned format which must be read with DeserializeDictionary64.
+// The numbers are little endian whatever the byte order of the
+// machine.
+func (c *Compressor) SerializeDictionary() ([]byte, error) {
+	return c.SerializeDictionaryOrder(binary.LittleEndian)
+}
+
+// SerializeDictionaryOrder is like SerializeDictionary but writes the
+// fingerprints and positions in the byte order given, for tools that
+// expect big endian numbers.  The order is not recorded so it must be
+// read with the same order passed to DeserializeDictionaryOrder (or
+// DeserializeDictionary64Order).
+func (c *Compressor) SerializeDictionaryOrder(order binary.ByteOrder) ([]byte, error) {
+	if len(c.dict.H64) > 0 {
+		buf := bytes.NewBuffer(make([]byte, 0,
+			len(dictMagic)+1+len(c.dict.H64)*(4+8)))
+
+		buf.WriteString(dictMagic)
+		buf.WriteByte(dictVersion64)
+
+		for k, v := range c.dict.H64 {
+			if err := binary.Write(buf, order, k); err != nil {
+				return nil, err
+			}
+			if err := binary.Write(buf, order, v); err != nil {
+				return nil, err
+			}
+		}
+
+		return buf.Bytes(), nil
+	}
+
+	if len(c.dict.H) > 0 {
+
+		// This reserves enough space in o to store the entire map
+		// with the worse case encoding. The worse case encoding is
+		// likely to be used for the map keys (because they are
+		// hashes) but not for the offset values which will in general
+		// be small.
+
+		buf := bytes.NewBuffer(make([]byte, 0,
+			len(c.dict.H)*2*binary.MaxVarintLen32))
+
+		for k, v := range c.dict.H {
+			if err := binary.Write(buf, order, k); err != nil {
+				return nil, err
+			}
+			if err := binary.Write(buf, order, v); err != nil {
+				return nil, err
+			}
+		}
+
+		return buf.Bytes(), nil
+	}
+
+	return []byte{}, nil
+}
+
+// ErrCorruptDictionary is returned when deserializing a dictionary
+// which is not a whole number of entries long, typically because it
+// has been truncated
+var ErrCorruptDictionary = errors.New("corrupt serialized dictionary")
+
+// DeserializeDictionary reads the H part of the Dictionary from a
+// []byte previously created with SerializeDictionary.  If o is not a
+// whole number of entries long then ErrCorruptDictionary is returned
+// and nothing is added to m.
+func DeserializeDictionary(o []byte, m map[uint32]uint32) error {
+	return DeserializeDictionaryOrder(o, m, binary.LittleEndian)
+}
+
+// DeserializeDictionaryOrder is like DeserializeDictionary but reads
+// numbers in the byte order given to SerializeDictionaryOrder.
+func DeserializeDictionaryOrder(o []byte, m map[uint32]uint32, order binary.ByteOrder) error {
+	if len(o)%8 != 0 {
+		return fmt.Errorf("%w: length %d is not a multiple of 8",
+			ErrCorruptDictionary, len(o))
+	}
+
+	buf := bytes.NewBuffer(o)
+
+	for entries := 0; buf.Len() > 0; entries++ {
+		var k uint32
+
+		if err := binary.Read(buf, order, &k); err != nil {
+			return fmt.Errorf("%w after %d entries", err, entries)
+		}
+		var v uint32
+		if err := binary.Read(buf, order, &v); err != nil {
+			return fmt.Errorf("%w after %d entries", err, entries)
+		}
+		m[k] = v
+	}
+
+	return nil
+}
+
+// SerializeFullDictionary turns the entire Dictionary (both Dict and
+// its hash table) into a single []byte so that it can be cached as
+// one value.
+//
+// The serialized form is the four byte header (dictMagic and
+// dictVersionFull), the length of Dict as a little endian uint64,
+// the bytes of Dict, a byte giving the size of each position (4 for
+// H and 8 for H64) and then the little endian fingerprint/position
+// pairs.
+func (c *Compressor) SerializeFullDictionary() ([]byte, error) {
+	width := 4
+	entries := len(c.dict.H)
+	if c.dict.H64 != nil {
+		width = 8
+		entries = len(c.dict.H64)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0,
+		len(dictMagic)+1+8+len(c.dict.Dict)+1+entries*(4+width)))
+
+	buf.WriteString(dictMagic)
+	buf.WriteByte(dictVersionFull)
+	if err := binary.Write(buf, binary.LittleEndian, uint64(len(c.dict.Dict))); err != nil {
+		return nil, err
+	}
+	buf.Write(c.dict.Dict)
+	buf.WriteByte(byte(width))
+
+	for k, v := range c.dict.H {
+		if err := binary.Write(buf, binary.LittleEndian, k); err != nil {
+			return nil, err
+		}
+		if err := binary.Write(buf, binary.LittleEndian, v); err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range c.dict.H64 {
+		if err := binary.Write(buf, binary.LittleEndian, k); err != nil {
+			return nil, err
+		}
+		if err := binary.Write(buf, binary.LittleEndian, v); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DeserializeFullDictionary recreates a Dictionary from a []byte
+// previously created with SerializeFullDictionary.  The returned
+// Dict refers to the memory of o.
+func DeserializeFullDictionary(o []byte) (*Dictionary, error) {
+	header := len(dictMagic) + 1
+	if len(o) < header+8 || string(o[:len(dictMagic)]) != dictMagic {
+		return nil, errors.New("serialized dictionary has no header")
+	}
+	if v := o[len(dictMagic)]; v != dictVersionFull {
+		return nil, fmt.Errorf("unsupported serialized dictionary version %d", v)
+	}
+	o = o[header:]
+
+	n := binary.LittleEndian.Uint64(o)
+	o = o[8:]
+	if n >= uint64(len(o)) {
+		return nil, fmt.Errorf("%w: dictionary of %d bytes is truncated",
+			ErrCorruptDictionary, n)
+	}
+
+	d := &Dictionary{Dict: o[:n]}
+	width := o[n]
+	o = o[n+1:]
+
+	switch width {
+	case 4:
+		d.H = make(map[uint32]uint32, len(o)/8)
+		if err := DeserializeDictionary(o, d.H); err != nil {
+			return nil, err
+		}
+
+	case 8:
+		if len(o)%12 != 0 {
+			return nil, fmt.Errorf("%w: length %d is not a multiple of 12",
+				ErrCorruptDictionary, len(o))
+		}
+		d.Wide = true
+		d.H64 = make(map[uint32]uint64, len(o)/12)
+		buf := bytes.NewBuffer(o)
+		for buf.Len() > 0 {
+			var k uint32
+			if err := binary.Read(buf, binary.LittleEndian, &k); err != nil {
+				return nil, err
+			}
+			var v uint64
+			if err := binary.Read(buf, binary.LittleEndian, &v); err != nil {
+				return nil, err
+			}
+			d.H64[k] = v
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported position size %d", width)
+	}
+
+	return d, nil
+}
+
+// DeserializeDictionary64 reads the H64 part of a Dictionary from a
+// []byte previously created with SerializeDictionary from a
+// dictionary using 64-bit positions
+func DeserializeDictionary64(o []byte, m map[uint32]uint64) error {
+	return DeserializeDictionary64Order(o, m, binary.LittleEndian)
+}
+
+// DeserializeDictionary64Order is like DeserializeDictionary64 but
+// reads numbers in the byte order given to SerializeDictionaryOrder.
+func DeserializeDictionary64Order(o []byte, m map[uint32]uint64, order binary.ByteOrder) error {
+	if len(o) < len(dictMagic)+1 || string(o[:len(dictMagic)]) != dictMagic {
+		return errors.New("serialized dictionary has no 64-bit header")
+	}
+	if v := o[len(dictMagic)]; v != dictVersion64 {
+		return fmt.Errorf("unsupported serialized dictionary version %d", v)
+	}
+
+	o = o[len(dictMagic)+1:]
+	if len(o)%12 != 0 {
+		return fmt.Errorf("%w: length %d is not a multiple of 12",
+			ErrCorruptDictionary, len(o))
+	}
+
+	buf := bytes.NewBuffer(o)
+
+	for entries := 0; buf.Len() > 0; entries++ {
+		var k uint32
+
+		if err := binary.Read(buf, order, &k); err != nil {
+			return fmt.Errorf("%w after %d entries", err, entries)
+		}
+		var v uint64
+		if err := binary.Read(buf, order, &v); err != nil {
+			return fmt.Errorf("%w after %d entries", err, entries)
+		}
+		m[k] = v
+	}
+
+	return nil
+}
+
+// An Expander is the complete state of the expander returned by NewExpander
+type Expander struct {
+	r io.Reader // The io.Reader from which the raw compressed data
+	// is read
+	d []byte // Data read from r is stored here so that
+	// compressed back references can be handled
+	to   int    // Position in d to which the caller has read
+	dict []byte // Dictionary to decompress against, if set then
+	// decompression is done referncing this.  If not
+	// then references are internal.
+	self bool // Set if references are internal
+
+	// State carried between calls to Read so that a section of the
+	// compressed stream can be returned across several calls
+
+	left uint64 // Bytes of the current uncompressed section still to
+	// be read from r
+	ref []byte // Remainder of the current back reference still to be
+	// copied out
+	err error // Sticky error (including io.EOF) once the stream ends
+
+	check bool   // Set if the stream has a checksum trailer
+	crc   uint32 // Running CRC-32 of the data returned so far
+
+	maxRef uint64 // If non-zero the longest reference allowed
+
+	delta bool   // Set if reference offsets are relative (ctrlDelta)
+	prev  uint64 // End of the previous reference when delta is set
+
+	combined bool // Set if offsets after the dictionary refer to the
+	// output (ctrlCombined)
+	ended bool // Set if the stream ended with ctrlEnd
+
+	src []byte // The whole compressed stream if it is in memory
+
+	reg DictionaryRegistry // If set the dictionaries that the stream
+	// can name with ctrlDictionaryID
+
+	// If ra is set the dictionary is read from it rather than from
+	// dict.  A reference to it is copied through buf with raLeft bytes
+	// at raOff still to be read once e.ref is empty.
+
+	ra     io.ReaderAt
+	raSize uint64
+	raOff  uint64
+	raLeft uint64
+	buf    []byte
+
+	// An internal reference at runFrom that overlaps its output still
+	// has runLeft bytes to produce at output position runOff.  The
+	// output it produces repeats every runPeriod bytes.
+	runFrom   uint64
+	runOff    uint64
+	runLeft   uint64
+	runPeriod uint64
+
+	// If window is set only the last window bytes (or a little more)
+	// of the output are kept in d for internal references, and d[0]
+	// is at position base of the output
+	window uint64
+	base   uint64
+
+	prefixed bool // Set if each stream is preceded by its length
+
+	// Number of bytes of the compressed stream read and of output
+	// produced, used to report where corrupt data was found
+
+	in  uint64
+	out uint64
+}
+
+// Errors for an invalid compressed stream, a bad reference or the
+// wrong dictionary are, or wrap, one of these (a truncated stream
+// gives io.ErrUnexpectedEOF) so that errors.Is can tell the kind of
+// failure apart from the details given in the message.  Misuse of the
+// API, such as ErrNoWriter and ErrClosed, has errors of its own.
+var (
+	// ErrCorruptStream is wrapped by every error the Expander (and
+	// DecompressedSize and DebugDecode) return for a compressed stream
+	// which cannot be valid, usually together with the position in
+	// the stream and the more specific error below
+	ErrCorruptStream = errors.New("corrupt stream")
+
+	// ErrMalformedVarint is returned (wrapped with the position in the
+	// stream) by the Expander if a varint is too long or overflows 64
+	// bits
+	ErrMalformedVarint = errors.New("malformed varint")
+
+	// ErrReferenceOutOfBounds is wrapped by the errors for a reference
+	// outside the dictionary or the output, whether found by the
+	// Expander or by the Compressor before it is written
+	ErrReferenceOutOfBounds = errors.New("reference out of bounds")
+
+	// ErrDictionaryMismatch is wrapped by the errors for a dictionary
+	// which is not the one a stream was compressed with, which was
+	// built for another block size or whose hash table refers to
+	// blocks outside Dict
+	ErrDictionaryMismatch = errors.New("dictionary mismatch")
+)
+
+// A kindError has its own message but is of the kind given by one of
+// the errors above
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func (k *kindError) Error() string { return k.msg }
+func (k *kindError) Unwrap() error { return k.kind }
+
+// errorf: formats an error of the given kind
+func errorf(kind error, format string, args ...interface{}) error {
+	return &kindError{kind: kind, msg: fmt.Sprintf(format, args...)}
+}
+
+// errExpanderPanic is returned (and all output discarded) if the
+// expander hits an unexpected panic while decoding
+var errExpanderPanic = errors.New("panic caught inside expander")
+
+// isBoundsError: reports whether x, recovered from a panic, is an
+// index or slice out of range error, which is what corrupt input that
+// got past the checks would cause.  Any other panic is a bug and is
+// not recovered from.
+func isBoundsError(x interface{}) bool {
+	err, ok := x.(runtime.Error)
+	return ok && strings.Contains(err.Error(), "out of range")
+}
+
+// corrupt wraps an error found in the compressed stream with the
+// position at which it was found
+func (e *Expander) corrupt(err error) error {
+	return fmt.Errorf("%w at input byte %d after %d output bytes: %w",
+		ErrCorruptStream, e.in, e.out, err)
+}
+
+// NewExpander creates a new decompressor.  Pass in an io.Reader that
+// can be used to read the raw compressed data.  The Expander
+// implements io.Reader and so calling Read() decompress data and
+// reads the actual input.  If dict is empty then the data must have
+// been compressed without a dictionary and references are resolved
+// against the data already decompressed.
+func NewExpander(r io.Reader, dict []byte) *Expander {
+	e := Expander{}
+	e.r = r
+	e.to = 0
+	e.dict = dict
+	e.self = len(dict) == 0
+	return &e
+}
+
+// NewBufferedExpander is like NewExpander but expands the compressed
+// stream held in data.  Since the whole stream is available it can be
+// looked ahead in without buffering it again (see DecompressedSize)
+// and expanded again from the start with Rewind.
+func NewBufferedExpander(data []byte, dict []byte) *Expander {
+	e := NewExpander(bytes.NewReader(data), dict)
+	e.src = data
+	return e
+}
+
+// NewLengthPrefixedExpander is like NewExpander but expands a stream
+// written with SetLengthPrefix.  Exactly the number of bytes given by
+// the length are read from r, so r is left at the end of the stream
+// and (after Reset with r) the next stream can be expanded.  A stream
+// shorter than its length gives io.ErrUnexpectedEOF.
+func NewLengthPrefixedExpander(r io.Reader, dict []byte) *Expander {
+	e := NewExpander(&prefixReader{r: r}, dict)
+	e.prefixed = true
+	return e
+}
+
+// A prefixReader reads the length of a stream from r and then only the
+// stream
+type prefixReader struct {
+	r    io.Reader
+	read bool   // Set once the length has been read
+	left uint64 // Number of bytes of the stream still to be read
+}
+
+// ReadByte reads the length one byte at a time so as not to read any
+// of the stream
+func (p *prefixReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(p.r, b[:])
+	return b[0], err
+}
+
+func (p *prefixReader) Read(b []byte) (int, error) {
+	if !p.read {
+		u, err := binary.ReadUvarint(p)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%w: length prefix: %w", ErrCorruptStream, ErrMalformedVarint)
+		}
+		p.read, p.left = true, u
+	}
+	if p.left == 0 {
+		return 0, io.EOF
+	}
+	if uint64(len(b)) > p.left {
+		b = b[:p.left]
+	}
+	n, err := p.r.Read(b)
+	p.left -= uint64(n)
+	if err == io.EOF && p.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Rewind starts expanding the stream of an Expander created with
+// NewBufferedExpander from the beginning again.  It returns an error
+// for any other Expander.
+func (e *Expander) Rewind() error {
+	if e.src == nil {
+		return errors.New("only a buffered expander can be rewound")
+	}
+	e.restart(bytes.NewReader(e.src))
+	return nil
+}
+
+// Reset discards the state of the Expander so that it can be reused
+// to expand another stream read from r using dict, as if it had been
+// created by NewExpander.  The memory used to hold the output for
+// references without a dictionary is kept and reused.  Options set on
+// the Expander (such as SetMaxReferenceLength) and any registry are
+// kept, and an Expander created by NewLengthPrefixedExpander still
+// expects the stream to be preceded by its length.
+func (e *Expander) Reset(r io.Reader, dict []byte) {
+	if e.prefixed {
+		r = &prefixReader{r: r}
+	}
+	e.restart(r)
+	e.to = 0
+	e.dict = dict
+	e.self = len(dict) == 0
+	e.src = nil
+	e.ra = nil
+	e.raSize = 0
+}
+
+// restart: clears the state of the stream being expanded so that
+// expansion starts again reading from r
+func (e *Expander) restart(r io.Reader) {
+	e.r = r
+	e.d = e.d[:0]
+	e.left = 0
+	e.ref = nil
+	e.err = nil
+	e.check = false
+	e.crc = 0
+	e.in = 0
+	e.out = 0
+	e.delta = false
+	e.prev = 0
+	e.combined = false
+	e.ended = false
+	e.raOff = 0
+	e.raLeft = 0
+	e.runLeft = 0
+	e.base = 0
+	if e.reg != nil {
+		e.dict = nil
+		e.self = true
+	}
+}
+
+// NewExpanderFromDictionary is like NewExpander but takes the same
+// Dictionary that was passed to the Compressor.  Only d.Dict is used
+// to expand the data; a nil d means there is no dictionary.
+func NewExpanderFromDictionary(r io.Reader, d *Dictionary) *Expander {
+	if d == nil {
+		return NewExpander(r, nil)
+	}
+	return NewExpander(r, d.Dict)
+}
+
+// NewExpanderReaderAt is like NewExpander but the dictionary is the
+// size bytes of dict, which are read as references are expanded rather
+// than held in memory.  This is useful for very large dictionaries that
+// are stored on disk, at the cost of a ReadAt for each reference.
+func NewExpanderReaderAt(r io.Reader, dict io.ReaderAt, size int64) *Expander {
+	e := NewExpander(r, nil)
+	if size > 0 {
+		e.ra = dict
+		e.raSize = uint64(size)
+		e.self = false
+	}
+	return e
+}
+
+// A DictionaryRegistry maps the ids given to SetDictionaryID to the
+// dictionaries they stand for.
+type DictionaryRegistry map[uint32][]byte
+
+// NewExpanderWithRegistry is like NewExpander but the dictionary is
+// taken from reg using the id at the start of the stream (see
+// SetDictionaryID).  A stream without an id is expanded without a
+// dictionary and one whose id is not in reg is an error.
+func NewExpanderWithRegistry(r io.Reader, reg DictionaryRegistry) *Expander {
+	e := NewExpander(r, nil)
+	e.reg = reg
+	return e
+}
+
+// SetMaxReferenceLength limits the length of any single back
+// reference in the compressed stream. A longer reference is an error
+// which is reported before any data is copied.  This is useful when
+// decompressing data from an untrusted source.  Zero (the default)
+// means unlimited.
+func (e *Expander) SetMaxReferenceLength(n int) {
+	e.maxRef = uint64(n)
+}
+
+// SetWindow bounds the memory used to expand a stream compressed
+// without a dictionary (or with SetSelfReferences) to about 2n bytes
+// by only keeping the last n bytes of the output for references to
+// be resolved against, rather than all of it.  Every reference must
+// then start no more than n bytes before the position in the output
+// at which it is copied, which is the case for a stream compressed
+// with SetWindow(m) for any m up to n; a reference further back is an
+// error.  Zero, the default, keeps all the output.
+func (e *Expander) SetWindow(n int) {
+	e.window = uint64(n)
+}
+
+// slide discards the output before the last window bytes once more
+// than twice that is kept, so that copying it is amortized.  It must
+// not be called while e.ref may refer to d.  An overlapping reference
+// still being copied is moved forward by whole periods so that the
+// data it repeats is kept.
+func (e *Expander) slide() {
+	n := uint64(len(e.d))
+	if e.window == 0 || n <= 2*e.window || len(e.ref) > 0 {
+		return
+	}
+	cut := n - e.window
+	if e.runLeft > 0 {
+		if e.runFrom < cut {
+			e.runFrom += (cut - e.runFrom) / e.runPeriod * e.runPeriod
+		}
+		if e.runFrom < cut {
+			cut = e.runFrom
+		}
+		e.runFrom -= cut
+		e.runOff -= cut
+	}
+	e.d = e.d[:copy(e.d, e.d[cut:])]
+	e.base += cut
+}
+
+// DecompressedSize returns the number of bytes that the rest of the
+// stream will expand to so that the slice passed to Expand can be
+// sized in advance.  Since the underlying io.Reader need not be
+// seekable everything remaining in it is read and buffered in memory
+// to be expanded later, so this should not be used on very large or
+// endless streams (a buffered Expander uses its data directly).
+// References are not checked against the dictionary until the data is
+// expanded.
+func (e *Expander) DecompressedSize() (int, error) {
+	if e.err != nil && e.err != io.EOF {
+		return 0, e.err
+	}
+
+	data := e.src
+	if data != nil {
+		data = data[e.in:]
+	} else {
+		var err error
+		if data, err = ioutil.ReadAll(e.r); err != nil {
+			return 0, err
+		}
+		e.r = bytes.NewReader(data)
+	}
+
+	// The rest of the current uncompressed section comes first
+
+	if uint64(len(data)) < e.left {
+		return 0, io.ErrUnexpectedEOF
+	}
+	data = data[e.left:]
+
+	size := uint64(len(e.ref)) + e.left + e.raLeft + e.runLeft
+	for len(data) > 0 {
+		u, n := binary.Uvarint(data)
+		if err := uvarintError(n); err != nil {
+			return 0, err
+		}
+		data = data[n:]
+
+		if u != referenceMarker {
+			if u > uint64(len(data)) {
+				return 0, io.ErrUnexpectedEOF
+			}
+			size += u
+			data = data[u:]
+			continue
+		}
+
+		var v [2]uint64
+		for i := range v {
+			if v[i], n = binary.Uvarint(data); n <= 0 {
+				return 0, uvarintError(n)
+			}
+			data = data[n:]
+		}
+
+		// A zero length is a control section, all of which currently
+		// have a four byte payload
+
+		if v[1] == 0 {
+			if v[0] < ctrlIntegrity || v[0] > ctrlEnd {
+				return 0, errorf(ErrCorruptStream, "unknown control section %d", v[0])
+			}
+			if len(data) < 4 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			data = data[4:]
+			if v[0] == ctrlEnd {
+				break
+			}
+			continue
+		}
+
+		if v[1] > uint64(maxInt)-size {
+			return 0, errorf(ErrCorruptStream, "decompressed size is too large")
+		}
+		size += v[1]
+	}
+
+	return int(size), nil
+}
+
+// uvarintError: converts a failure of binary.Uvarint into an error
+func uvarintError(n int) error {
+	switch {
+	case n == 0:
+		return io.ErrUnexpectedEOF
+	case n < 0:
+		return fmt.Errorf("%w: %w", ErrCorruptStream, ErrMalformedVarint)
+	}
+	return nil
+}
+
+// maxInt is the largest value of an int
+const maxInt = int(^uint(0) >> 1)
+
+// readVarUint: since the compressed data consists of varints (see
+// bmcompress.go) for details then the fundamental operation is
+// reading varints
+func (e *Expander) readVarUint() (uint64, error) {
+	u := uint64(0)
+	b := make([]byte, 1)
+	m := uint64(1)
+	for i := 0; ; i++ {
+		if _, err := e.readFull(b); err != nil {
+
+			// Running out of data part way through a varint means
+			// the stream was truncated
+
+			if err == io.EOF && i > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		e.in++
+
+		// The last byte of a 64-bit varint can only hold one bit and
+		// must end it
+
+		if i == binary.MaxVarintLen64-1 && b[0] > 1 {
+			return 0, e.corrupt(ErrMalformedVarint)
+		}
+
+		u += m * uint64(b[0]&byte(0x7F))
+		m *= 128
+
+		if b[0] < 128 {
 			break
 		}
 	}
-	return nil
+
+	return u, nil
 }
 
-// writeUncompressedBlock: writes out a block of uncompressed data
-// preceded by the length of the block as a variable length integer
-func (c *Compressor) writeUncompressedBlock(d []byte) error {
-	if len(d) == 0 {
+// nextSection reads the header of the next section of the compressed
+// stream and sets up either e.left (for an uncompressed section) or
+// e.ref (for a back reference).  Returns io.EOF if the stream ended
+// cleanly between sections.  A reference to a dictionary which is an
+// io.ReaderAt is read into e.ref a piece at a time and the next piece
+// is read instead of a header until it is complete.
+func (e *Expander) nextSection() error {
+	if e.raLeft > 0 {
+		return e.fill()
+	}
+	e.slide()
+	if e.runLeft > 0 {
+		e.repeat()
 		return nil
 	}
-	if err := c.writeVarUint(uint32(len(d))); err != nil {
+
+	u, err := e.readVarUint()
+	if err != nil {
+		if err == io.EOF && e.check {
+			err = e.corrupt(errors.New("stream ended without a checksum"))
+		}
 		return err
 	}
-	if n, err := c.w.Write(d); err != nil {
-		return err
-	} else {
-		c.outSize += n
+
+	// If the value read is zero then it indicates a compressed
+	// section which is formed of two varints indicating the offset
+	// and length, if not then it's an uncompressed section
+
+	if u != referenceMarker {
+		e.left = u
+		return nil
 	}
-	return nil
-}
 
-// writeCompressedReference: writes out a block of compressed data
-// which simply consists of a reference to the start of a block to
-// copy and its length.  This is preceded by zero to indicate that
-// this is a block of compressed data
-func (c *Compressor) writeCompressedReference(start, offset uint32) error {
-	zero := []byte{0}
-	if n, err := c.w.Write(zero); err != nil {
+	var offset uint64
+	if offset, err = e.readVarUint(); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return err
-	} else {
-		c.outSize += n
 	}
-	if err := c.writeVarUint(start); err != nil {
+
+	var length uint64
+	if length, err = e.readVarUint(); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return err
 	}
 
-	return c.writeVarUint(offset)
+	if length == 0 {
+		return e.control(offset)
+	}
+	if e.delta {
+		offset = e.prev + unzigzag(offset)
+	}
+	e.prev = offset + length
 
-}
+	if e.maxRef > 0 && length > e.maxRef {
+		return e.corrupt(fmt.Errorf("reference length %d exceeds maximum %d",
+			length, e.maxRef))
+	}
 
-// Close tells the compressor that all the data has been written.
-// This does not close the underlying io.Writer.  This is where the
-// Bentley/McIlroy and Rabin/Karp algorithms are implemented.
-// Reference those papers for a full explanation.
-func (c *Compressor) Close() error {
-	var skip uint32
-	var last uint32
+	// Check that the reference lies entirely inside the dictionary
+	// (or the output produced so far for internal references) before
+	// slicing it. This is written so that offset+length cannot
+	// overflow.
 
-	// This points to the slice containing the buffer used as the
-	// dictionary for the compression.  This is either the data itself
-	// (for self referential compression) or its the dictionary set by
-	// SetDictionary
+	src, what := e.dict, "dictionary"
+	size := uint64(len(src))
+	if e.ra != nil {
+		size = e.raSize
+	}
+	internal := e.self
+	if e.combined && offset >= size {
+		offset -= size
+		internal = true
+	}
+	if internal {
+		src, what = e.d, "output"
+		size = uint64(len(src))
+		if offset < e.base {
+			return e.corrupt(errorf(ErrReferenceOutOfBounds, "reference at %d is before the last %d bytes of output kept",
+				offset, e.window))
+		}
+		offset -= e.base
+
+		// An internal reference may overlap the output that it
+		// produces, in which case it repeats the data from offset
+		// onwards as it is copied
+
+		if offset < size && length > size-offset {
+			e.ref = src[offset:]
+			e.runFrom = offset
+			e.runOff = size
+			e.runLeft = length - (size - offset)
+			e.runPeriod = size - offset
+			return nil
+		}
+	}
 
-	for x := range c.d {
-		i := uint32(x)
+	if offset > size || length > size-offset {
+		return e.corrupt(errorf(ErrReferenceOutOfBounds, "reference [%d,%d) exceeds %s length %d",
+			offset, offset+length, what, size))
+	}
 
-		// The first block bytes are consumed to calculate the
-		// fingerprint of the first block
+	if e.ra != nil && !internal {
+		e.raOff, e.raLeft = offset, length
+		return e.fill()
+	}
+	e.ref = src[offset : offset+length]
+	return nil
+}
 
-		if i < block {
-			c.f = (c.f*radix + uint32(c.d[i])) & clip
-		} else {
+// repeat sets e.ref to the next part of an internal reference which
+// overlaps its own output.  The output from the offset of the
+// reference onwards is the data between the offset and the start of
+// the reference repeated, so each part can be all of it rather than
+// a byte at a time and the parts double in size.
+func (e *Expander) repeat() {
+	n := e.runOff - e.runFrom
+	if n > e.runLeft {
+		n = e.runLeft
+	}
+	e.ref = e.d[e.runFrom : e.runFrom+n]
+	e.runOff += n
+	e.runLeft -= n
+}
 
-			// The data is broken up into non-overlapping blocks of
-			// size block.  The fingerprints of each block are stored
-			// in a hash table which keeps the position the first time
-			// the block was seen.
-			//
-			// The fingerprint of the current block which covers the
-			// block bytes (i-block,i] is calculated efficiently
-			//
-			// The canonical calculation is as follows:
-			//
-			// c.f = ( radix * ( c.f - c.d[i-block] * c.l ) + c.d[i] ) % prime
-			//
-			// But a number of tricks are performed to make this
-			// faster. First, values of c.d[i-block] * c.l are kept in
-			// an array so they are only calculated once. Second, the
-			// modulo calculation is done using bit twiddling rather
-			// than division.
+// raBuffer is the size of the buffer used to read references from a
+// dictionary which is an io.ReaderAt
+const raBuffer = 32 * 1024
 
-			if i >= skip {
+// fill reads the next part of a reference to a dictionary which is an
+// io.ReaderAt into e.ref
+func (e *Expander) fill() error {
+	if e.buf == nil {
+		e.buf = make([]byte, raBuffer)
+	}
+	c := e.buf
+	if uint64(len(c)) > e.raLeft {
+		c = c[:e.raLeft]
+	}
+	n, err := e.ra.ReadAt(c, int64(e.raOff))
+	if n < len(c) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	e.raOff += uint64(n)
+	e.raLeft -= uint64(n)
+	e.ref = c
+	return nil
+}
 
-				// If the new fingerprint appears in the hash table
-				// then this block has been seen before and can be
-				// encoded rather than emitted.  First must check that
-				// it's an actual match since there is a small
-				// probability of the hashing algorithm used for
-				// calculating fingerprints having a collision
+// maxEmptyReads is the number of times in a row that the underlying
+// io.Reader may return no data and no error before the Expander gives
+// up with io.ErrNoProgress
+const maxEmptyReads = 100
+
+// read reads from the underlying io.Reader into p, which must not be
+// empty.  A Read which returns neither data nor an error, which
+// io.Reader allows but discourages, is retried.
+func (e *Expander) read(p []byte) (int, error) {
+	for i := 0; i < maxEmptyReads; i++ {
+		n, err := e.r.Read(p)
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	return 0, io.ErrNoProgress
+}
 
-				e, exists := c.dict.H[c.f]
-				match := false
-				if exists {
-					match = true
-					var j uint32
-					for j = 0; j < block; j++ {
-						if c.dict.Dict[e+j] != c.d[i-block+j] {
-							match = false
-							break
-						}
-					}
-				}
+// readFull is io.ReadFull using read
+func (e *Expander) readFull(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		m, err := e.read(p[n:])
+		n += m
+		if err != nil {
+			if err == io.EOF && n > 0 && n < len(p) {
+				err = io.ErrUnexpectedEOF
+			}
+			if n == len(p) {
+				err = nil
+			}
+			return n, err
+		}
+	}
+	return n, nil
+}
 
-				// If there's a match then we need to figure out how
-				// far we can extend it backwards up to block-1 bytes
-				// and forward as far as possible
+// readLiteral reads as much of the current uncompressed section as
+// will fit in p from the underlying reader, returning the number of
+// bytes read.  Any error is stored in e.err.
+func (e *Expander) readLiteral(p []byte) int {
+	if uint64(len(p)) > e.left {
+		p = p[:e.left]
+	}
+	n, err := e.read(p)
+	e.left -= uint64(n)
+	e.in += uint64(n)
+	if err != nil {
+		if err == io.EOF && e.left > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		e.err = err
+	}
+	return n
+}
 
-				if match {
-					var s uint32
-					for s = 1; s < block; s++ {
-						if i < last+block+s {
-							break
-						}
+// control handles a control section of type code
+func (e *Expander) control(code uint64) error {
+	var buf [4]byte
+	n, err := e.readFull(buf[:])
+	e.in += uint64(n)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	sum := binary.BigEndian.Uint32(buf[:])
 
-						if e < s {
-							break
-						}
+	switch code {
+	case ctrlIntegrity:
+		want, err := e.dictionaryChecksum()
+		if err != nil {
+			return err
+		}
+		if sum != want {
+			return e.corrupt(errorf(ErrDictionaryMismatch, "dictionary checksum mismatch"))
+		}
+		e.check = true
+		e.crc = 0
 
-						if i < block+s {
-							break
-						}
+	case ctrlChecksum:
+		if !e.check {
+			return e.corrupt(errors.New("checksum without integrity header"))
+		}
+		if sum != e.crc {
+			return e.corrupt(errors.New("checksum mismatch"))
+		}
+		e.check = false
 
-						if c.dict.Dict[e-s] != c.d[i-block-s] {
-							break
-						}
-					}
-					s--
+	case ctrlDelta:
+		e.delta = true
+		e.prev = 0
 
-					var f uint32
-					for f = 0; f < uint32(len(c.d))-i; f++ {
-						if e+block+f >= uint32(len(c.dict.Dict)) {
-							break
-						}
+	// Without a registry the id is ignored and the dictionary given
+	// to NewExpander used
 
-						if c.dict.Dict[e+block+f] != c.d[i+f] {
-							break
-						}
-					}
+	case ctrlDictionaryID:
+		if e.reg == nil {
+			break
+		}
+		if e.out > 0 || e.check {
+			return e.corrupt(errors.New("dictionary id after start of stream"))
+		}
+		dict, ok := e.reg[sum]
+		if !ok {
+			return e.corrupt(errorf(ErrDictionaryMismatch, "unknown dictionary id %d", sum))
+		}
+		e.dict = dict
+		e.self = len(dict) == 0
 
-					if err := c.writeUncompressedBlock(c.d[last : i-block-s]); err != nil {
-						return err
-					}
-					if err := c.writeCompressedReference(e-s, block+s+f); err != nil {
-						return err
-					}
-					skip = i + f + block + 1
-					last = i + f
-				}
+	// The output before the section would not have been kept
 
-			}
+	case ctrlCombined:
+		if e.out > 0 {
+			return e.corrupt(errors.New("self references after start of stream"))
+		}
+		e.combined = true
 
-			c.f = ((c.f-c.save[c.d[i-block]])*radix + uint32(c.d[i])) & clip
+	case ctrlEnd:
+		if e.check {
+			return e.corrupt(errors.New("stream ended without a checksum"))
 		}
-	}
+		e.ended = true
+		return io.EOF
 
-	if last < uint32(len(c.d)) {
-		return c.writeUncompressedBlock(c.d[last:])
+	default:
+		return e.corrupt(fmt.Errorf("unknown control section %d", code))
 	}
 
 	return nil
 }
 
-// Ratio retrieves the compression ratio of the last compression
-// performed. Only makes sense after Close() has been called. The
-// returned value is an integer representing the size of the output as
-// a percentage of the input * 100. If the return value is -1 then it
-// indicates that there was no input.
-func (c *Compressor) Ratio() int {
-	if c.inSize > 0 {
-		return (10000 * c.outSize) / c.inSize
+// dictionaryChecksum returns the CRC-32 of the dictionary
+func (e *Expander) dictionaryChecksum() (uint32, error) {
+	if e.ra == nil {
+		return crc32.ChecksumIEEE(e.dict), nil
 	}
-	return -1
-}
-
-// Get the size in bytes of the last compressed output. Only makes
-// sense after Close() has been called.
-func (c *Compressor) CompressedSize() int {
-	return c.outSize
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, io.NewSectionReader(e.ra, 0, int64(e.raSize))); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
 }
 
-// Get the size in bytes of the last uncompressed input. Only makes
-// sense after Close() has been called.
-func (c *Compressor) InputSize() int {
-	return c.inSize
+// produced is called with every piece of output as it is returned to
+// the caller
+func (e *Expander) produced(p []byte) {
+	e.out += uint64(len(p))
+	if e.check {
+		e.crc = crc32.Update(e.crc, crc32.IEEETable, p)
+	}
+	if e.self || e.combined {
+		e.d = append(e.d, p...)
+		e.slide()
+	}
 }
 
-// SerializeDictionary turns H (the map part of the Dictionary) into a
-// []byte for easy storage in memcached or elsewhere.
-func (c *Compressor) SerializeDictionary() ([]byte, error) {
-	if len(c.dict.H) > 0 {
-
-		// This reserves enough space in o to store the entire map
-		// with the worse case encoding. The worse case encoding is
-		// likely to be used for the map keys (because they are
-		// hashes) but not for the offset values which will in general
-		// be small.
+// Read implements the io.Reader interface. It decodes just enough of
+// the compressed stream to fill p. A section that doesn't fit in p
+// is carried over to the next call to Read without re-reading it from
+// the underlying io.Reader.
+func (e *Expander) Read(p []byte) (n int, err error) {
 
-		buf := bytes.NewBuffer(make([]byte, 0,
-			len(c.dict.H)*2*binary.MaxVarintLen32))
+	// This is done to capture the extreme case that an out of
+	// bounds error occurs in the expansion. References are checked
+	// against the dictionary before being copied so this should
+	// never happen, but it is kept as a last resort safety net.
+	// Other panics are passed on.  Built with bounds checks disabled
+	// (-gcflags=-B, as the Makefile does) there is no panic to recover
+	// from and the length checks in nextSection are the only
+	// protection.
 
-		for k, v := range c.dict.H {
-			if err := binary.Write(buf, binary.LittleEndian, k); err != nil {
-				return nil, err
-			}
-			if err := binary.Write(buf, binary.LittleEndian, v); err != nil {
-				return nil, err
+	defer func() {
+		if x := recover(); x != nil {
+			if !isBoundsError(x) {
+				panic(x)
 			}
+			e.err = e.corrupt(errExpanderPanic)
+			n = 0
+			err = e.err
 		}
+	}()
 
-		return buf.Bytes(), nil
+	for n < len(p) && e.err == nil {
+		switch {
+		case len(e.ref) > 0:
+			c := copy(p[n:], e.ref)
+			e.ref = e.ref[c:]
+			e.produced(p[n : n+c])
+			n += c
+
+		case e.left > 0:
+			c := e.readLiteral(p[n:])
+			e.produced(p[n : n+c])
+			n += c
+
+		default:
+			e.err = e.nextSection()
+		}
 	}
 
-	return []byte{}, nil
+	if n > 0 {
+		return n, nil
+	}
+	return 0, e.err
 }
 
-// DeserializeDictionary reads the H part of the Dictionary from a
-// []byte previously created with SerializeDictionary
-func DeserializeDictionary(o []byte, m map[uint32]uint32) error {
-	buf := bytes.NewBuffer(o)
+// Expand expands the compressed data read from src using dict (which
+// must be the dictionary the data was compressed with) and appends it
+// to dst, returning the extended slice.
+func Expand(dst []byte, src io.Reader, dict []byte) ([]byte, error) {
+	return NewExpander(src, dict).Expand(dst)
+}
 
-	for buf.Len() > 0 {
-		var k uint32
+// DecodeAppend expands the compressed stream held in src using dict
+// and appends the output to dst, returning the extended slice.  Since
+// the whole stream is in memory its decompressed size is found first
+// so that dst is grown at most once.  Errors are those of Expand: on
+// corrupt input the output decoded before the error is returned with
+// it, except after a panic caught in the expander when dst is
+// returned unchanged.
+func DecodeAppend(dst, src, dict []byte) ([]byte, error) {
+	e := NewBufferedExpander(src, dict)
+	if n, err := e.DecompressedSize(); err == nil && cap(dst)-len(dst) < n {
+		q := make([]byte, len(dst), len(dst)+n)
+		copy(q, dst)
+		dst = q
+	}
+	return e.Expand(dst)
+}
 
-		if err := binary.Read(buf, binary.LittleEndian, &k); err != nil {
-			return err
+// Expand expands the compressed data into a buffer. The decompressed
+// data is appended to p and the extended slice returned, so anything
+// already in p[:len(p)] is kept in front of it: to preallocate space
+// for the output pass make([]byte, 0, n) rather than make([]byte, n).
+// This is a convenience wrapper around Read that buffers the entire
+// output in memory.
+func (e *Expander) Expand(p []byte) ([]byte, error) {
+	q := p
+	var one [1]byte
+	for {
+
+		// When q is full a single byte is read to find out whether
+		// there is any more output before growing it, so that a q
+		// with exactly the right capacity is never reallocated
+
+		var n int
+		var err error
+		if len(q) == cap(q) {
+			n, err = e.Read(one[:])
+			q = append(q, one[:n]...)
+		} else {
+			n, err = e.Read(q[len(q):cap(q)])
+			q = q[:len(q)+n]
 		}
-		var v uint32
-		if err := binary.Read(buf, binary.LittleEndian, &v); err != nil {
-			return err
+
+		switch {
+		case err == io.EOF:
+			return q, nil
+
+		// If the expander panicked then we return no data at all
+		// to prevent any bad data being returned to the client.
+
+		case errors.Is(err, errExpanderPanic):
+			return p, err
+
+		case err != nil:
+			return q, err
+
+		case n == 0:
+			return q, nil
 		}
-		m[k] = v
 	}
+}
 
-	return nil
+// ExpandConsumed is like Expand but also returns the number of bytes
+// of the compressed stream read by this call.  The Expander never
+// reads beyond the sections it decodes, so when a stream is embedded
+// in a larger message and its end is marked by the underlying reader
+// (for example with io.LimitReader) the message can be parsed further
+// from the point that consumed gives, even if an error is returned.
+func (e *Expander) ExpandConsumed(p []byte) ([]byte, int, error) {
+	in := e.in
+	q, err := e.Expand(p)
+	return q, int(e.in - in), err
 }
 
-// An Expander is the complete state of the expander returned by NewExpander
-type Expander struct {
-	r io.Reader // The io.Reader from which the raw compressed data
-	// is read
-	d []byte // Data read from r is stored here so that
-	// compressed back references can be handled
-	to   int    // Position in d to which the caller has read
-	dict []byte // Dictionary to decompress against, if set then
-	// decompression is done referncing this.  If not
-	// then references are internal.
+// ExpandNext expands the next of several streams written one after
+// the other, each ending with the marker written by SetEndMarker, and
+// appends it to p.  Nothing after the marker is read, so the
+// underlying reader is left at the start of the next stream.  A last
+// stream without a marker is expanded up to the end of the reader.
+// When there are no more streams p is returned with io.EOF.
+func (e *Expander) ExpandNext(p []byte) ([]byte, error) {
+	switch {
+	case e.ended:
+		in := e.in
+		e.restart(e.r)
+		e.in = in
+	case e.err == io.EOF:
+		return p, io.EOF
+	}
+
+	in := e.in
+	q, err := e.Expand(p)
+	if err == nil && !e.ended && e.in == in {
+		return p, io.EOF
+	}
+	return q, err
 }
 
-// NewExpander creates a new decompressor.  Pass in an io.Reader that
-// can be used to read the raw compressed data.  The Expander
-// implements io.Reader and so calling Read() decompress data and
-// reads the actual input.
-func NewExpander(r io.Reader, dict []byte) *Expander {
-	e := Expander{}
-	e.r = r
-	e.to = 0
-	e.dict = dict
-	return &e
+// ExpandWith is like Expand but expands the data against dict instead
+// of the dictionary the Expander was created with, which is left
+// unchanged for later calls.  Since references are resolved against
+// whichever dictionary is in use when they are read, dict should be
+// used for the whole of a stream.
+func (e *Expander) ExpandWith(p, dict []byte) ([]byte, error) {
+	saved, ra, self := e.dict, e.ra, e.self
+	e.dict, e.ra = dict, nil
+	e.self = len(dict) == 0
+	defer func() {
+		e.dict, e.ra, e.self = saved, ra, self
+	}()
+	return e.Expand(p)
 }
 
-// readVarUint: since the compressed data consists of varints (see
-// bmcompress.go) for details then the fundamental operation is
-// reading varints
-func (e *Expander) readVarUint() (uint, error) {
-	u := uint(0)
-	b := make([]byte, 1)
-	m := uint(1)
+// AppendTo is the same as Expand: the decompressed data is appended
+// to dst and the extended slice returned.
+func (e *Expander) AppendTo(dst []byte) ([]byte, error) {
+	return e.Expand(dst)
+}
+
+// Bytes expands the compressed data and returns a new slice holding
+// exactly the decompressed data.
+func (e *Expander) Bytes() ([]byte, error) {
+	return e.Expand(nil)
+}
+
+// ExpandN decodes exactly n bytes of output and appends them to dst,
+// returning the extended slice.  It stops as soon as n bytes have been
+// produced, which may be part way through a section, and nothing more
+// of the compressed stream is read: the rest of the section is
+// returned by the next call to ExpandN, Read or Expand.  This allows a
+// compressed stream to be embedded in a larger protocol where its
+// decompressed length is known (note that a checksum trailer after the
+// last byte is left unread).  If the stream ends before n bytes
+// io.ErrUnexpectedEOF is returned with the data produced.
+func (e *Expander) ExpandN(dst []byte, n int) ([]byte, error) {
+	if n <= 0 {
+		return dst, nil
+	}
+	l := len(dst)
+	if cap(dst)-l < n {
+		q := make([]byte, l, l+n)
+		copy(q, dst)
+		dst = q
+	}
+	q := dst[:l+n]
+
+	for m := l; m < len(q); {
+		c, err := e.Read(q[m:])
+		m += c
+		switch {
+		case err == io.EOF:
+			return q[:m], io.ErrUnexpectedEOF
+
+		case errors.Is(err, errExpanderPanic):
+			return dst[:l], err
+
+		case err != nil:
+			return q[:m], err
+		}
+	}
+	return q, nil
+}
+
+// ExpandBounded is like Expand but never grows p: at most cap(p) bytes
+// are appended to p[:len(p)].  If the stream expands to more than
+// that io.ErrShortBuffer is returned with the data produced so far,
+// and expansion can be resumed by calling ExpandBounded (or Expand)
+// again with a larger buffer.  InputOffset gives the amount of the
+// compressed stream that has been consumed.
+func (e *Expander) ExpandBounded(p []byte) ([]byte, error) {
+	q := p
 	for {
-		if n, err := e.r.Read(b); n != 1 || err != nil {
-			return 0, err
+		if len(q) == cap(q) {
+
+			// Reading the following section headers (but no data)
+			// finds out whether the stream is complete, while
+			// leaving any data to be read by the next call
+
+			for e.err == nil && len(e.ref) == 0 && e.left == 0 && e.raLeft == 0 && e.runLeft == 0 {
+				e.err = e.nextSection()
+			}
+			switch e.err {
+			case io.EOF:
+				return q, nil
+			case nil:
+				return q, io.ErrShortBuffer
+			default:
+				return q, e.err
+			}
 		}
 
-		u += m * uint(b[0]&byte(0x7F))
-		m *= 128
+		n, err := e.Read(q[len(q):cap(q)])
+		q = q[:len(q)+n]
 
-		if b[0] < 128 {
-			break
+		switch {
+		case err == io.EOF:
+			return q, nil
+
+		case errors.Is(err, errExpanderPanic):
+			return p, err
+
+		case err != nil:
+			return q, err
+
+		case n == 0:
+			return q, nil
 		}
 	}
+}
 
-	return u, nil
+// InputOffset returns the number of bytes of the compressed stream
+// that have been consumed so far.
+func (e *Expander) InputOffset() int64 {
+	return int64(e.in)
 }
 
-// Expand expands the compressed data into a buffer
-func (e *Expander) Expand(p []byte) (q []byte, err error) {
+// WriteTo implements the io.WriterTo interface. It decodes the rest
+// of the compressed stream writing uncompressed sections and resolved
+// back references directly to w as they are decoded, rather than
+// building up the output in memory. Returns the number of bytes
+// written to w.
+func (e *Expander) WriteTo(w io.Writer) (n int64, err error) {
 
-	// This is done to capture the extreme case that an out of
-	// bounds error occurs in the expansion. This should never
-	// happen, but this protects against a corrupt compressed
-	// block. If this occurs then we return no data at all to
-	// prevent any bad data being returned to the client.
+	// As in Read an out of range error is a last resort, and never
+	// happens with bounds checks disabled where the checks in
+	// nextSection are all there is
 
 	defer func() {
 		if x := recover(); x != nil {
-			err = errors.New("panic caught inside expander")
-			p = p[:0]
+			if !isBoundsError(x) {
+				panic(x)
+			}
+			e.err = e.corrupt(errExpanderPanic)
+			err = e.err
 		}
 	}()
 
-	q = p
-A:
-	for {
-		var u uint
-		if u, err = e.readVarUint(); err != nil {
-			break A
-		}
-
-		// If the value read is zero then it indicates a compressed
-		// section which is formed of two varints indicating the
-		// offset and length, if not then it's an uncompressed section
-
-		if u == 0 {
-			var offset uint
-			if offset, err = e.readVarUint(); err != nil {
-				break A
+	var buf []byte
+	for e.err == nil {
+		switch {
+		case len(e.ref) > 0:
+			c, werr := w.Write(e.ref)
+			e.produced(e.ref[:c])
+			n += int64(c)
+			e.ref = e.ref[c:]
+			if werr != nil {
+				return n, werr
 			}
-
-			var length uint
-			if length, err = e.readVarUint(); err != nil {
-				break A
+			if len(e.ref) > 0 {
+				return n, io.ErrShortWrite
 			}
 
-			q = append(q, e.dict[offset:offset+length]...)
-		} else {
-			left := u
-			for left > 0 {
-				buf := make([]byte, left)
-				var n int
-				if n, err = e.r.Read(buf); err != nil {
-					break A
+		case e.left > 0:
+			if buf == nil {
+				buf = make([]byte, 32*1024)
+			}
+			c := e.readLiteral(buf)
+			if c > 0 {
+				e.produced(buf[:c])
+				m, werr := w.Write(buf[:c])
+				n += int64(m)
+				if werr != nil {
+					return n, werr
 				}
-				if n > 0 {
-					left -= uint(n)
-					q = append(q, buf[0:n]...)
-				} else {
-					break A
+				if m < c {
+					return n, io.ErrShortWrite
 				}
 			}
+
+		default:
+			e.err = e.nextSection()
 		}
 	}
 
-	if err == io.EOF {
-		err = nil
+	if e.err == io.EOF {
+		return n, nil
 	}
-
-	return
+	return n, e.err
 }
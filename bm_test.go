@@ -6,7 +6,17 @@ package bm
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"runtime"
+	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func assert(t *testing.T, b bool) {
@@ -324,3 +334,3303 @@ func TestSerializeDeserialize(t *testing.T) {
 		assert(t, temp[k] == v)
 	}
 }
+
+// readCounter counts how many times Read is called on the underlying
+// io.Reader
+type readCounter struct {
+	r     *bytes.Buffer
+	count int
+}
+
+func (r *readCounter) Read(p []byte) (int, error) {
+	r.count++
+	return r.r.Read(p)
+}
+
+func TestStreamingRead(t *testing.T) {
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	d := new(Dictionary)
+	s := []byte("the quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dog")
+	dict := s
+	d.Dict = dict
+	co.SetDictionary(d)
+	s1 := string(s)
+	s = []byte(s1 + "HELLO JOHN" + s1)
+	co.Write(s)
+	co.Close()
+	assert(t, b.Len() == 19)
+
+	rc := &readCounter{r: b}
+	ex := NewExpander(rc, dict)
+	o := make([]byte, 0)
+	buf := make([]byte, 7)
+	for {
+		n, err := ex.Read(buf)
+		o = append(o, buf[:n]...)
+		if err != nil {
+			assert(t, err == io.EOF)
+			break
+		}
+		assert(t, n > 0)
+	}
+	assert(t, bytes.Compare(o, s) == 0)
+
+	// The two references of 129 bytes each are emitted across many
+	// calls to Read but must only be read from the underlying reader
+	// once: 19 bytes of compressed data with a 10 byte literal read
+	// in 2 pieces gives 9 varint reads, 2 literal reads and a final
+	// read returning io.EOF
+
+	assert(t, rc.count == 12)
+}
+
+func TestStreamingReadOneByte(t *testing.T) {
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	d := new(Dictionary)
+	s := []byte("the quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dog")
+	dict := s
+	d.Dict = dict
+	co.SetDictionary(d)
+	s = []byte("THEthe quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dogDOG")
+	co.Write(s)
+	co.Close()
+
+	ex := NewExpander(b, dict)
+	o, err := ioutil.ReadAll(iotest.OneByteReader(ex))
+	assert(t, err == nil)
+	assert(t, bytes.Compare(o, s) == 0)
+}
+
+func TestStreamingReadTruncated(t *testing.T) {
+	b := bytes.NewBuffer([]byte{5, 'H', 'E', 'L'})
+	ex := NewExpander(b, nil)
+	out := make([]byte, 0)
+	o, err := ex.Expand(out)
+	assert(t, err == io.ErrUnexpectedEOF)
+	assert(t, bytes.Compare(o, []byte("HEL")) == 0)
+}
+
+func TestReset(t *testing.T) {
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	d := new(Dictionary)
+	s := []byte("the quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dog")
+	dict := s
+	d.Dict = dict
+	co.SetDictionary(d)
+	s = []byte("THE QUICK BROWN FOX JUMPS OVER THE LAZY DOGTHE QUICK BROWN FOX JUMPS OVER THE LAZY DOG THE QUICK BROWN FOX JUMPS OVER THE LAZY DOG")
+	co.Write(s)
+	co.Close()
+	assert(t, co.CompressedSize() == 132)
+
+	s1 := string(dict)
+	s = []byte(s1 + "HELLO JOHN" + s1)
+	b1 := new(bytes.Buffer)
+	co.Reset(b1)
+	assert(t, co.Ratio() == -1)
+	assert(t, co.InputSize() == 0)
+	assert(t, co.CompressedSize() == 0)
+	co.Write(s)
+	assert(t, co.Close() == nil)
+
+	b2 := new(bytes.Buffer)
+	fresh := NewCompressor()
+	fresh.SetWriter(b2)
+	fresh.SetDictionary(d)
+	fresh.Write(s)
+	assert(t, fresh.Close() == nil)
+
+	assert(t, bytes.Compare(b1.Bytes(), b2.Bytes()) == 0)
+	assert(t, co.InputSize() == len(s))
+	assert(t, co.CompressedSize() == 19)
+	assert(t, co.CompressedSize() == fresh.CompressedSize())
+	assert(t, co.Ratio() == fresh.Ratio())
+	assert(t, co.Ratio() == (10000*b1.Len()/len(s)))
+}
+
+func TestNoWriter(t *testing.T) {
+	co := NewCompressor()
+	n, err := co.Write([]byte("hello"))
+	assert(t, n == 0)
+	assert(t, err == ErrNoWriter)
+	assert(t, co.InputSize() == 0)
+	assert(t, co.Close() == ErrNoWriter)
+
+	// Without a dictionary the compressor still works once it has
+	// somewhere to write to
+
+	b := new(bytes.Buffer)
+	co.SetWriter(b)
+	_, err = co.Write([]byte("hello"))
+	assert(t, err == nil)
+	assert(t, co.Close() == nil)
+	assert(t, bytes.Compare(b.Bytes(), []byte("\x05hello")) == 0)
+}
+
+func TestCorruptReference(t *testing.T) {
+	dict := []byte("the quick brown fox jumps over the lazy dog")
+
+	b := bytes.NewBuffer([]byte{3, 'T', 'H', 'E', 0, 40, 10})
+	ex := NewExpander(b, dict)
+	o, err := ex.Expand(make([]byte, 0))
+	assert(t, err != nil)
+	assert(t, err.Error() == "corrupt stream at input byte 7 after 3 output bytes: reference [40,50) exceeds dictionary length 43")
+	assert(t, bytes.Compare(o, []byte("THE")) == 0)
+
+	b = bytes.NewBuffer([]byte{0, 50, 1})
+	ex = NewExpander(b, dict)
+	_, err = ex.Expand(make([]byte, 0))
+	assert(t, err != nil)
+	assert(t, err.Error() == "corrupt stream at input byte 3 after 0 output bytes: reference [50,51) exceeds dictionary length 43")
+
+	b = bytes.NewBuffer([]byte{0, 0, 1})
+	ex = NewExpander(b, nil)
+	_, err = ex.Expand(make([]byte, 0))
+	assert(t, err != nil)
+	assert(t, err.Error() == "corrupt stream at input byte 3 after 0 output bytes: reference [0,1) exceeds output length 0")
+
+	// A length that would overflow offset+length must still be
+	// rejected
+
+	b = bytes.NewBuffer([]byte{0, 1, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0x01})
+	ex = NewExpander(b, dict)
+	_, err = ex.Expand(make([]byte, 0))
+	assert(t, err != nil)
+	assert(t, !errors.Is(err, errExpanderPanic))
+
+	// A reference ending exactly at the end of the dictionary is
+	// fine
+
+	b = bytes.NewBuffer([]byte{0, 40, 3})
+	ex = NewExpander(b, dict)
+	o, err = ex.Expand(make([]byte, 0))
+	assert(t, err == nil)
+	assert(t, bytes.Compare(o, []byte("dog")) == 0)
+}
+
+func TestWideDictionary(t *testing.T) {
+	s := []byte("the quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dog")
+	dict := s
+	s1 := string(s)
+	s = []byte("THE" + s1 + "HELLO JOHN" + s1 + "DOG")
+
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.SetDictionary(&Dictionary{Dict: dict})
+	co.Write(s)
+	assert(t, co.Close() == nil)
+
+	wb := new(bytes.Buffer)
+	wco := NewCompressor()
+	wco.SetWriter(wb)
+	wco.SetDictionary(&Dictionary{Dict: dict, Wide: true})
+	assert(t, wco.GetDictionary().H == nil)
+	assert(t, len(wco.GetDictionary().H64) == len(co.GetDictionary().H))
+	wco.Write(s)
+	assert(t, wco.Close() == nil)
+	assert(t, bytes.Compare(b.Bytes(), wb.Bytes()) == 0)
+
+	serialized, err := wco.SerializeDictionary()
+	assert(t, err == nil)
+	assert(t, string(serialized[:3]) == "BMD")
+	m := make(map[uint32]uint64)
+	assert(t, DeserializeDictionary64(serialized, m) == nil)
+	assert(t, len(m) == len(wco.GetDictionary().H64))
+	for k, v := range m {
+		assert(t, wco.GetDictionary().H64[k] == v)
+	}
+
+	serialized, err = co.SerializeDictionary()
+	assert(t, err == nil)
+	assert(t, DeserializeDictionary64(serialized, m) != nil)
+
+	ex := NewExpander(wb, dict)
+	o, err := ex.Expand(make([]byte, 0))
+	assert(t, err == nil)
+	assert(t, bytes.Compare(o, s) == 0)
+}
+
+func TestVarUint64(t *testing.T) {
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	values := []uint64{0, 1, 127, 128, 1<<32 - 1, 1 << 32, 5 << 40, 1<<64 - 1}
+	for _, v := range values {
+		assert(t, co.writeVarUint(v) == nil)
+	}
+	ex := NewExpander(b, nil)
+	for _, v := range values {
+		u, err := ex.readVarUint()
+		assert(t, err == nil)
+		assert(t, u == v)
+	}
+}
+
+func TestMalformedVarint(t *testing.T) {
+
+	// Too many continuation bytes and a tenth byte which would
+	// overflow 64 bits
+
+	long := append(bytes.Repeat([]byte{0x80}, 20), 1)
+	over := append(bytes.Repeat([]byte{0xff}, 9), 2)
+	for _, v := range [][]byte{long, over} {
+		ex := NewExpander(bytes.NewReader(v), nil)
+		_, err := ex.readVarUint()
+		assert(t, errors.Is(err, ErrMalformedVarint))
+		assert(t, ex.InputOffset() == 10)
+
+		ex = NewExpander(bytes.NewReader(append([]byte{0, 1}, v...)), nil)
+		_, err = ex.Expand(make([]byte, 0))
+		assert(t, errors.Is(err, ErrMalformedVarint))
+
+		ex = NewExpander(bytes.NewReader(v), nil)
+		_, err = ex.DecompressedSize()
+		assert(t, errors.Is(err, ErrMalformedVarint) && errors.Is(err, ErrCorruptStream))
+	}
+}
+
+// shortWriter accepts at most max bytes per call to Write and fails
+// once limit bytes have been written
+type shortWriter struct {
+	b     bytes.Buffer
+	max   int
+	limit int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if w.b.Len() >= w.limit {
+		return 0, io.ErrClosedPipe
+	}
+	if len(p) > w.max {
+		p = p[:w.max]
+	}
+	return w.b.Write(p)
+}
+
+func TestWriteTo(t *testing.T) {
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	d := new(Dictionary)
+	s := []byte("the quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dog")
+	dict := s
+	d.Dict = dict
+	co.SetDictionary(d)
+	s1 := string(s)
+	s = []byte("THE" + s1 + "HELLO JOHN" + s1 + "DOG")
+	co.Write(s)
+	co.Close()
+	compressed := b.Bytes()
+
+	out := new(bytes.Buffer)
+	ex := NewExpander(bytes.NewReader(compressed), dict)
+	n, err := ex.WriteTo(out)
+	assert(t, err == nil)
+	assert(t, n == int64(len(s)))
+	assert(t, bytes.Compare(out.Bytes(), s) == 0)
+
+	// io.Copy uses WriteTo
+
+	out.Reset()
+	ex = NewExpander(bytes.NewReader(compressed), dict)
+	n, err = io.Copy(out, ex)
+	assert(t, err == nil)
+	assert(t, n == int64(len(s)))
+	assert(t, bytes.Compare(out.Bytes(), s) == 0)
+
+	sw := &shortWriter{max: 10, limit: len(s)}
+	ex = NewExpander(bytes.NewReader(compressed), dict)
+	n, err = ex.WriteTo(sw)
+	assert(t, err == io.ErrShortWrite)
+	assert(t, n == 13)
+
+	sw = &shortWriter{max: len(s), limit: 100}
+	ex = NewExpander(bytes.NewReader(compressed), dict)
+	n, err = ex.WriteTo(sw)
+	assert(t, err == io.ErrClosedPipe)
+	assert(t, n == int64(3+len(dict)))
+}
+
+func TestMatchStats(t *testing.T) {
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	s := []byte("the quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dog")
+	dict := s
+	co.SetDictionary(&Dictionary{Dict: dict})
+	co.Write(s)
+	co.Close()
+	hits, fp := co.MatchStats()
+	assert(t, hits == 1)
+	assert(t, fp == 0)
+
+	// Pairing the hash table of one dictionary with different bytes
+	// means that every hash hit fails verification
+
+	h := co.GetDictionary().H
+	other := bytes.ToUpper(dict)
+	b.Reset()
+	co.Reset(b)
+	co.SetDictionary(&Dictionary{Dict: other, H: h})
+	co.Write(s)
+	co.Close()
+	hits, fp = co.MatchStats()
+	assert(t, hits == 0)
+	assert(t, fp > 0)
+	assert(t, b.Len() == len(s)+2)
+
+	// Counters are reset by each run
+
+	b.Reset()
+	co.Reset(b)
+	hits, fp = co.MatchStats()
+	assert(t, hits == 0)
+	assert(t, fp == 0)
+}
+
+func TestChecksum(t *testing.T) {
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.SetChecksum(true)
+	s := []byte("the quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dog")
+	dict := s
+	co.SetDictionary(&Dictionary{Dict: dict})
+	s1 := string(s)
+	s = []byte("THE" + s1 + "HELLO JOHN" + s1 + "DOG")
+	co.Write(s)
+	assert(t, co.Close() == nil)
+	assert(t, co.CompressedSize() == b.Len())
+	assert(t, b.Len() == 27+2*7)
+	compressed := b.Bytes()
+
+	ex := NewExpander(bytes.NewReader(compressed), dict)
+	o, err := ex.Expand(make([]byte, 0))
+	assert(t, err == nil)
+	assert(t, bytes.Compare(o, s) == 0)
+
+	out := new(bytes.Buffer)
+	ex = NewExpander(bytes.NewReader(compressed), dict)
+	_, err = ex.WriteTo(out)
+	assert(t, err == nil)
+	assert(t, bytes.Compare(out.Bytes(), s) == 0)
+
+	// A different dictionary is detected before any output is
+	// produced
+
+	ex = NewExpander(bytes.NewReader(compressed), bytes.ToUpper(dict))
+	o, err = ex.Expand(make([]byte, 0))
+	assert(t, err != nil)
+	assert(t, err.Error() == "corrupt stream at input byte 7 after 0 output bytes: dictionary checksum mismatch")
+	assert(t, len(o) == 0)
+
+	// Corrupting a literal is detected at the end
+
+	corrupt := append([]byte{}, compressed...)
+	corrupt[8] = 'X'
+	ex = NewExpander(bytes.NewReader(corrupt), dict)
+	_, err = ex.Expand(make([]byte, 0))
+	assert(t, err != nil)
+	assert(t, err.Error() == "corrupt stream at input byte 41 after 274 output bytes: checksum mismatch")
+
+	// As is a missing trailer
+
+	ex = NewExpander(bytes.NewReader(compressed[:len(compressed)-7]), dict)
+	_, err = ex.Expand(make([]byte, 0))
+	assert(t, err != nil)
+	assert(t, err.Error() == "corrupt stream at input byte 34 after 274 output bytes: stream ended without a checksum")
+}
+
+// randomBytes returns n bytes of reproducible random data
+func randomBytes(n int, seed int64) []byte {
+	r := rand.New(rand.NewSource(seed))
+	b := make([]byte, n)
+	r.Read(b)
+	return b
+}
+
+func TestMinMatch(t *testing.T) {
+
+	// The input is a copy of dict[500:1000] but its first block also
+	// appears at the start of the dictionary. The first match found
+	// is then only one block long and stops a much longer match being
+	// found.
+
+	dict := randomBytes(1000, 1)
+	input := append([]byte{}, dict[500:]...)
+	copy(dict[0:50], input[0:50])
+	d := BuildDictionary(dict)
+
+	compress := func(min int) []byte {
+		b := new(bytes.Buffer)
+		co := NewCompressor()
+		co.SetWriter(b)
+		co.SetDictionary(d)
+		co.SetMinMatch(min)
+		co.Write(input)
+		assert(t, co.Close() == nil)
+
+		ex := NewExpander(bytes.NewReader(b.Bytes()), dict)
+		o, err := ex.Expand(make([]byte, 0))
+		assert(t, err == nil)
+		assert(t, bytes.Compare(o, input) == 0)
+
+		return b.Bytes()
+	}
+
+	assert(t, bytes.Compare(compress(0), compress(int(block))) == 0)
+	short := compress(0)
+	long := compress(100)
+	assert(t, len(long) < len(short))
+	assert(t, len(long) == 7)
+
+	// Nothing is long enough
+
+	assert(t, len(compress(len(input)+1)) == len(input)+2)
+}
+
+func TestMaxReferenceLength(t *testing.T) {
+	s := []byte("the quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dog")
+	dict := s
+	compressed := []byte{3, 'T', 'H', 'E', 0, 0, 0x81, 1}
+
+	ex := NewExpander(bytes.NewReader(compressed), dict)
+	ex.SetMaxReferenceLength(129)
+	o, err := ex.Expand(make([]byte, 0))
+	assert(t, err == nil)
+	assert(t, len(o) == 3+129)
+
+	ex = NewExpander(bytes.NewReader(compressed), dict)
+	ex.SetMaxReferenceLength(128)
+	o, err = ex.Expand(make([]byte, 0))
+	assert(t, err != nil)
+	assert(t, err.Error() == "corrupt stream at input byte 8 after 3 output bytes: reference length 129 exceeds maximum 128")
+	assert(t, bytes.Compare(o, []byte("THE")) == 0)
+}
+
+func TestReadFrom(t *testing.T) {
+	s := []byte("the quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dog")
+	d := BuildDictionary(s)
+	input := append(randomBytes(100000, 2), bytes.Repeat(s, 100)...)
+
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.SetDictionary(d)
+	for p := input; len(p) > 0; {
+		n := 1000
+		if n > len(p) {
+			n = len(p)
+		}
+		co.Write(p[:n])
+		p = p[n:]
+	}
+	assert(t, co.Close() == nil)
+
+	rb := new(bytes.Buffer)
+	rco := NewCompressor()
+	rco.SetWriter(rb)
+	rco.SetDictionary(d)
+	n, err := io.Copy(rco, iotest.HalfReader(bytes.NewReader(input)))
+	assert(t, err == nil)
+	assert(t, n == int64(len(input)))
+	assert(t, rco.InputSize() == len(input))
+	assert(t, bytes.Compare(rco.d, input) == 0)
+	assert(t, rco.Close() == nil)
+	assert(t, bytes.Compare(b.Bytes(), rb.Bytes()) == 0)
+
+	rco = NewCompressor()
+	_, err = rco.ReadFrom(bytes.NewReader(input))
+	assert(t, err == ErrNoWriter)
+}
+
+func TestGrow(t *testing.T) {
+	s := []byte("the quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dog")
+	input := bytes.Repeat(s, 1000)
+
+	co := NewCompressor()
+	co.SetWriter(new(bytes.Buffer))
+	co.Grow(len(input))
+	assert(t, cap(co.d) == len(input))
+	buf := co.d[:1]
+	for i := 0; i < 1000; i++ {
+		co.Write(s)
+	}
+	assert(t, &buf[0] == &co.d[0])
+	assert(t, bytes.Compare(co.d, input) == 0)
+
+	// Growing keeps what has already been written
+
+	co.Grow(10)
+	assert(t, cap(co.d) >= len(input)+10)
+	assert(t, bytes.Compare(co.d, input) == 0)
+
+	// The output is the same with and without Grow
+
+	input = append(input, randomBytes(5000, 121)...)
+	input = append(input, input[1000:3000]...)
+	var out [2]*bytes.Buffer
+	for i := range out {
+		out[i] = new(bytes.Buffer)
+		co = NewCompressor()
+		co.SetWriter(out[i])
+		if i == 1 {
+			co.Grow(len(input))
+		}
+		for p := input; len(p) > 0; {
+			n := len(p)
+			if n > 4096 {
+				n = 4096
+			}
+			co.Write(p[:n])
+			p = p[n:]
+		}
+		assert(t, co.Close() == nil)
+	}
+	assert(t, bytes.Compare(out[0].Bytes(), out[1].Bytes()) == 0)
+}
+
+func TestSerializeFullDictionary(t *testing.T) {
+	s := []byte("the quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dog")
+	dict := bytes.Repeat(s, 10)
+
+	for _, wide := range []bool{false, true} {
+		co := NewCompressor()
+		co.SetDictionary(&Dictionary{Dict: dict, Wide: wide})
+		serialized, err := co.SerializeFullDictionary()
+		assert(t, err == nil)
+
+		d, err := DeserializeFullDictionary(serialized)
+		assert(t, err == nil)
+		assert(t, bytes.Compare(d.Dict, dict) == 0)
+		assert(t, d.Wide == wide)
+		if wide {
+			assert(t, len(d.H64) == len(co.GetDictionary().H64))
+			for k, v := range d.H64 {
+				assert(t, co.GetDictionary().H64[k] == v)
+			}
+		} else {
+			assert(t, len(d.H) == len(co.GetDictionary().H))
+			for k, v := range d.H {
+				assert(t, co.GetDictionary().H[k] == v)
+			}
+		}
+
+		// The deserialized dictionary is ready to use without
+		// rebuilding the hash table
+
+		b := new(bytes.Buffer)
+		co = NewCompressor()
+		co.SetWriter(b)
+		co.SetDictionary(d)
+		co.Write(s)
+		assert(t, co.Close() == nil)
+		assert(t, b.Len() == 4)
+
+		_, err = DeserializeFullDictionary(serialized[:20])
+		assert(t, err != nil)
+	}
+
+	_, err := DeserializeFullDictionary([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12})
+	assert(t, err != nil)
+}
+
+func TestDeserializeTruncated(t *testing.T) {
+	co := NewCompressor()
+	co.SetDictionary(BuildDictionary(randomBytes(1000, 3)))
+	serialized, err := co.SerializeDictionary()
+	assert(t, err == nil)
+	assert(t, len(serialized) == 19*8)
+
+	m := make(map[uint32]uint32)
+	err = DeserializeDictionary(serialized[:len(serialized)-3], m)
+	assert(t, errors.Is(err, ErrCorruptDictionary))
+	assert(t, len(m) == 0)
+
+	// A truncation that happens to be on an entry boundary can't be
+	// detected but an empty blob is not an error
+
+	assert(t, DeserializeDictionary(serialized[:len(serialized)-8], m) == nil)
+	assert(t, len(m) == 18)
+	m = make(map[uint32]uint32)
+	assert(t, DeserializeDictionary([]byte{}, m) == nil)
+	assert(t, len(m) == 0)
+
+	co.SetDictionary(&Dictionary{Dict: randomBytes(1000, 3), Wide: true})
+	serialized, err = co.SerializeDictionary()
+	assert(t, err == nil)
+	m64 := make(map[uint32]uint64)
+	err = DeserializeDictionary64(serialized[:len(serialized)-1], m64)
+	assert(t, errors.Is(err, ErrCorruptDictionary))
+	assert(t, len(m64) == 0)
+
+	serialized, err = co.SerializeFullDictionary()
+	assert(t, err == nil)
+	_, err = DeserializeFullDictionary(serialized[:len(serialized)-1])
+	assert(t, errors.Is(err, ErrCorruptDictionary))
+	_, err = DeserializeFullDictionary(serialized[:100])
+	assert(t, errors.Is(err, ErrCorruptDictionary))
+}
+
+func TestSerializeDictionaryOrder(t *testing.T) {
+	co := NewCompressor()
+	co.SetDictionary(&Dictionary{Dict: randomBytes(100, 3), H: map[uint32]uint32{0x01020304: 5}})
+
+	// The default is little endian whatever the machine
+
+	serialized, err := co.SerializeDictionary()
+	assert(t, err == nil)
+	assert(t, bytes.Equal(serialized, []byte{4, 3, 2, 1, 5, 0, 0, 0}))
+
+	serialized, err = co.SerializeDictionaryOrder(binary.BigEndian)
+	assert(t, err == nil)
+	assert(t, bytes.Equal(serialized, []byte{1, 2, 3, 4, 0, 0, 0, 5}))
+	m := make(map[uint32]uint32)
+	assert(t, DeserializeDictionaryOrder(serialized, m, binary.BigEndian) == nil)
+	assert(t, len(m) == 1 && m[0x01020304] == 5)
+
+	d := BuildDictionary(randomBytes(1000, 3))
+	co.SetDictionary(d)
+	serialized, err = co.SerializeDictionaryOrder(binary.BigEndian)
+	assert(t, err == nil)
+	m = make(map[uint32]uint32)
+	assert(t, DeserializeDictionaryOrder(serialized, m, binary.BigEndian) == nil)
+	assert(t, len(m) == len(d.H))
+	for k, v := range d.H {
+		assert(t, m[k] == v)
+	}
+
+	co.SetDictionary(&Dictionary{Dict: randomBytes(1000, 3), Wide: true})
+	serialized, err = co.SerializeDictionaryOrder(binary.BigEndian)
+	assert(t, err == nil)
+	m64 := make(map[uint32]uint64)
+	assert(t, DeserializeDictionary64Order(serialized, m64, binary.BigEndian) == nil)
+	assert(t, len(m64) == len(co.GetDictionary().H64))
+	for k, v := range co.GetDictionary().H64 {
+		assert(t, m64[k] == v)
+	}
+}
+
+// cancelWriter cancels a context after a number of bytes have been
+// written to it
+type cancelWriter struct {
+	bytes.Buffer
+	after  int
+	cancel context.CancelFunc
+}
+
+func (w *cancelWriter) Write(p []byte) (int, error) {
+	if w.Len() >= w.after {
+		w.cancel()
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestCloseContext(t *testing.T) {
+	s := []byte("the quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dog")
+	d := BuildDictionary(s)
+	input := bytes.Repeat(append(randomBytes(1000, 4), s...), 100)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &cancelWriter{after: 10000, cancel: cancel}
+	co := NewCompressor()
+	co.SetWriter(w)
+	co.SetDictionary(d)
+	co.Write(input)
+	err := co.CloseContext(ctx)
+	assert(t, err == context.Canceled)
+	assert(t, co.Ratio() == -1)
+	assert(t, co.InputSize() == len(input))
+	assert(t, co.CompressedSize() == w.Len())
+	assert(t, w.Len() < len(input)/2)
+
+	// Once reset the compressor works normally
+
+	b := new(bytes.Buffer)
+	co.Reset(b)
+	co.Write(input)
+	assert(t, co.CloseContext(context.Background()) == nil)
+	assert(t, co.Ratio() > 0)
+	ex := NewExpander(b, s)
+	o, err := ex.Expand(make([]byte, 0))
+	assert(t, err == nil)
+	assert(t, bytes.Compare(o, input) == 0)
+
+	// An already cancelled context writes nothing
+
+	b.Reset()
+	co.Reset(b)
+	co.Write(input)
+	assert(t, co.CloseContext(ctx) == context.Canceled)
+	assert(t, b.Len() == 0)
+}
+
+func TestSelfReferential(t *testing.T) {
+	s := []byte("the quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dog")
+	s1 := string(s)
+	input := []byte("THE" + s1 + "HELLO JOHN" + s1 + "DOG")
+
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.Write(input)
+	assert(t, co.Close() == nil)
+	assert(t, b.Len() == 194)
+	hits, _ := co.MatchStats()
+	assert(t, hits == 1)
+
+	ex := NewExpander(bytes.NewReader(b.Bytes()), nil)
+	o, err := ex.Expand(make([]byte, 0))
+	assert(t, err == nil)
+	assert(t, bytes.Compare(o, input) == 0)
+
+	out := new(bytes.Buffer)
+	ex = NewExpander(bytes.NewReader(b.Bytes()), nil)
+	_, err = ex.WriteTo(out)
+	assert(t, err == nil)
+	assert(t, bytes.Compare(out.Bytes(), input) == 0)
+
+	ex = NewExpander(bytes.NewReader(b.Bytes()), nil)
+	o, err = ioutil.ReadAll(iotest.OneByteReader(ex))
+	assert(t, err == nil)
+	assert(t, bytes.Compare(o, input) == 0)
+
+	// Random data with long repeats
+
+	input = randomBytes(10000, 5)
+	input = append(input, input[1234:5678]...)
+	input = append(input, randomBytes(100, 6)...)
+	input = append(input, input[100:3000]...)
+	b.Reset()
+	co.Reset(b)
+	co.Write(input)
+	assert(t, co.Close() == nil)
+	assert(t, b.Len() < 10200)
+	ex = NewExpander(bytes.NewReader(b.Bytes()), nil)
+	o, err = ex.Expand(make([]byte, 0))
+	assert(t, err == nil)
+	assert(t, bytes.Compare(o, input) == 0)
+
+	// A run of a single byte can only refer back to blocks
+	// which do not overlap the data being produced
+
+	input = bytes.Repeat([]byte{'a'}, 1000)
+	b.Reset()
+	co.Reset(b)
+	co.Write(input)
+	assert(t, co.Close() == nil)
+	assert(t, b.Len() < 200)
+	ex = NewExpander(bytes.NewReader(b.Bytes()), nil)
+	o, err = ex.Expand(make([]byte, 0))
+	assert(t, err == nil)
+	assert(t, bytes.Compare(o, input) == 0)
+}
+
+func TestStructure(t *testing.T) {
+	s := []byte("the quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dog")
+	dict := s
+	s1 := string(s)
+	input := []byte("THE" + s1 + "HELLO JOHN" + s1 + "DOG")
+
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.SetChecksum(true)
+	co.SetDictionary(&Dictionary{Dict: dict})
+	co.Write(input)
+	assert(t, co.Close() == nil)
+	refs, lits := co.Structure()
+	assert(t, refs == 2)
+	assert(t, lits == 3)
+
+	b.Reset()
+	co.Reset(b)
+	refs, lits = co.Structure()
+	assert(t, refs == 0)
+	assert(t, lits == 0)
+	co.Write(dict)
+	assert(t, co.Close() == nil)
+	refs, lits = co.Structure()
+	assert(t, refs == 1)
+	assert(t, lits == 0)
+}
+
+func TestFlush(t *testing.T) {
+	dict := randomBytes(5000, 7)
+	parts := [][]byte{
+		dict[100:1200],
+		randomBytes(300, 8),
+		dict[2000:2999],
+		dict[100:1200],
+	}
+	var input []byte
+	for _, p := range parts {
+		input = append(input, p...)
+	}
+
+	for _, d := range [][]byte{dict, nil} {
+		b := new(bytes.Buffer)
+		co := NewCompressor()
+		co.SetWriter(b)
+		co.SetChecksum(true)
+		co.SetDictionary(&Dictionary{Dict: d})
+
+		// Each flush must write out everything written so far
+
+		sizes := []int{}
+		for _, p := range parts {
+			co.Write(p)
+			assert(t, co.Flush() == nil)
+			sizes = append(sizes, b.Len())
+		}
+		assert(t, co.Close() == nil)
+		for i := 1; i < len(sizes); i++ {
+			assert(t, sizes[i] > sizes[i-1])
+		}
+		assert(t, b.Len() < len(input)-1000)
+
+		ex := NewExpander(bytes.NewReader(b.Bytes()), d)
+		o, err := ex.Expand(make([]byte, 0))
+		assert(t, err == nil)
+		assert(t, bytes.Compare(o, input) == 0)
+
+		// The data compressed by a flush can be expanded before
+		// the stream is closed, although its checksum is missing
+
+		b.Reset()
+		co.Reset(b)
+		co.Write(parts[0])
+		assert(t, co.Flush() == nil)
+		ex = NewExpander(bytes.NewReader(b.Bytes()), d)
+		o, err = ex.Expand(make([]byte, 0))
+		assert(t, err != nil)
+		assert(t, bytes.Compare(o, parts[0]) == 0)
+	}
+
+	co := NewCompressor()
+	assert(t, co.Flush() == ErrNoWriter)
+}
+
+func TestCloseAllocs(t *testing.T) {
+	dict := randomBytes(100000, 9)
+	input := similar(dict)
+
+	out := new(bytes.Buffer)
+	out.Grow(len(input))
+	co := NewCompressor()
+	co.SetDictionary(BuildDictionary(dict))
+	co.SetChecksum(true)
+	co.Grow(len(input))
+
+	// Writing the section headers must not allocate however many
+	// references there are
+
+	allocs := testing.AllocsPerRun(10, func() {
+		out.Reset()
+		co.Reset(out)
+		co.Write(input)
+		co.Close()
+	})
+	assert(t, allocs == 0)
+	refs, _ := co.Structure()
+	assert(t, refs > 50)
+
+	ex := NewExpander(bytes.NewReader(out.Bytes()), dict)
+	o, err := ex.Expand(make([]byte, 0))
+	assert(t, err == nil)
+	assert(t, bytes.Compare(o, input) == 0)
+}
+
+func TestExpandShortReads(t *testing.T) {
+	dict := randomBytes(20000, 10)
+	input := append(randomBytes(30000, 11), dict[5000:15000]...)
+
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.SetDictionary(&Dictionary{Dict: dict})
+	co.Write(input)
+	assert(t, co.Close() == nil)
+
+	// Reading the compressed data one byte at a time means that the
+	// long literal section is read with thousands of short reads
+	// which must all be copied into the output without allocating
+
+	p := make([]byte, 0, len(input))
+	var o []byte
+	allocs := testing.AllocsPerRun(5, func() {
+		ex := NewExpander(iotest.OneByteReader(bytes.NewReader(b.Bytes())), dict)
+		var err error
+		o, err = ex.Expand(p)
+		assert(t, err == nil)
+	})
+	assert(t, allocs < 10)
+	assert(t, bytes.Compare(o, input) == 0)
+
+	ex := NewExpander(iotest.HalfReader(bytes.NewReader(b.Bytes())), dict)
+	out := new(bytes.Buffer)
+	_, err := ex.WriteTo(out)
+	assert(t, err == nil)
+	assert(t, bytes.Compare(out.Bytes(), input) == 0)
+}
+
+func TestDecompressedSize(t *testing.T) {
+	dict := randomBytes(20000, 12)
+	input := append(randomBytes(3000, 13), dict[5000:15000]...)
+	input = append(input, dict[100:900]...)
+
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.SetChecksum(true)
+	co.SetDictionary(&Dictionary{Dict: dict})
+	co.Write(input)
+	assert(t, co.Close() == nil)
+
+	// The reader is wrapped so that it cannot be seeked
+
+	ex := NewExpander(iotest.HalfReader(bytes.NewReader(b.Bytes())), dict)
+	n, err := ex.DecompressedSize()
+	assert(t, err == nil)
+	assert(t, n == len(input))
+	o, err := ex.Expand(make([]byte, 0, n))
+	assert(t, err == nil)
+	assert(t, len(o) == n && cap(o) == n)
+	assert(t, bytes.Compare(o, input) == 0)
+
+	// Part way through the stream only the rest is counted
+
+	ex = NewExpander(bytes.NewReader(b.Bytes()), dict)
+	p := make([]byte, 4000)
+	_, err = io.ReadFull(ex, p)
+	assert(t, err == nil)
+	n, err = ex.DecompressedSize()
+	assert(t, err == nil)
+	assert(t, n == len(input)-len(p))
+	o, err = ex.Expand(p)
+	assert(t, err == nil)
+	assert(t, bytes.Compare(o, input) == 0)
+
+	ex = NewExpander(bytes.NewReader(b.Bytes()[:b.Len()-10]), dict)
+	_, err = ex.DecompressedSize()
+	assert(t, err == io.ErrUnexpectedEOF)
+}
+
+func TestInconsistentDictionary(t *testing.T) {
+	dict := randomBytes(10000, 14)
+	d := BuildDictionary(dict)
+
+	// The hash table no longer matches the shortened dictionary
+
+	co := NewCompressor()
+	good := BuildDictionary(dict[:100])
+	assert(t, co.SetDictionary(good) == nil)
+	err := co.SetDictionary(&Dictionary{Dict: dict[:5000], H: d.H})
+	assert(t, err != nil)
+	assert(t, len(co.GetDictionary().Dict) == 100)
+
+	err = co.SetDictionary(&Dictionary{Dict: nil, H64: map[uint32]uint64{1: 1 << 63}})
+	assert(t, err != nil)
+
+	// Changing Dict after SetDictionary must not cause a panic when
+	// compressing
+
+	assert(t, co.SetDictionary(&Dictionary{Dict: dict, H: d.H}) == nil)
+	co.GetDictionary().Dict = dict[:5000]
+	b := new(bytes.Buffer)
+	co.SetWriter(b)
+	co.Write(dict)
+	assert(t, co.Close() == nil)
+	ex := NewExpander(bytes.NewReader(b.Bytes()), dict[:5000])
+	o, err := ex.Expand(make([]byte, 0))
+	assert(t, err == nil)
+	assert(t, bytes.Compare(o, dict) == 0)
+}
+
+func TestWriteString(t *testing.T) {
+	dict := "the quick brown fox jumps over the lazy dog, the quick brown fox jumps over the lazy dog"
+	input := "HELLO " + dict + " GOODBYE"
+
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.SetDictionary(&Dictionary{Dict: []byte(dict)})
+	n, err := io.WriteString(co, input)
+	assert(t, err == nil)
+	assert(t, n == len(input))
+	assert(t, co.InputSize() == len(input))
+	assert(t, co.Close() == nil)
+
+	b1 := new(bytes.Buffer)
+	co.Reset(b1)
+	co.Write([]byte(input))
+	assert(t, co.Close() == nil)
+	assert(t, bytes.Compare(b.Bytes(), b1.Bytes()) == 0)
+
+	co.Reset(b)
+	co.Grow(11 * len(input))
+	allocs := testing.AllocsPerRun(10, func() {
+		co.WriteString(input)
+	})
+	assert(t, allocs == 0)
+
+	co = NewCompressor()
+	_, err = co.WriteString(input)
+	assert(t, err == ErrNoWriter)
+}
+
+func TestCompressExpand(t *testing.T) {
+	dict := randomBytes(10000, 15)
+	input := append(randomBytes(500, 16), dict[1000:8000]...)
+
+	for _, d := range [][]byte{dict, nil} {
+		var dictionary *Dictionary
+		if d != nil {
+			dictionary = BuildDictionary(d)
+		}
+
+		b := new(bytes.Buffer)
+		ratio, err := Compress(b, input, dictionary)
+		assert(t, err == nil)
+		assert(t, ratio == 10000*b.Len()/len(input))
+
+		o, err := Expand([]byte("prefix"), b, d)
+		assert(t, err == nil)
+		assert(t, bytes.Compare(o, append([]byte("prefix"), input...)) == 0)
+	}
+
+	_, err := Compress(new(bytes.Buffer), input,
+		&Dictionary{Dict: dict[:10], H: BuildDictionary(dict).H})
+	assert(t, err != nil)
+}
+
+func TestClosed(t *testing.T) {
+	dict := randomBytes(5000, 17)
+	input := dict[1000:3000]
+
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.SetDictionary(&Dictionary{Dict: dict})
+	co.Write(input)
+	assert(t, co.Close() == nil)
+	size := b.Len()
+
+	_, err := co.Write(input)
+	assert(t, err == ErrClosed)
+	_, err = co.WriteString("hello")
+	assert(t, err == ErrClosed)
+	_, err = co.ReadFrom(bytes.NewReader(input))
+	assert(t, err == ErrClosed)
+	assert(t, co.Flush() == ErrClosed)
+	assert(t, co.Close() == ErrClosed)
+	assert(t, b.Len() == size)
+	assert(t, co.InputSize() == len(input))
+
+	// After Reset the Compressor can be used again and gives the same
+	// output
+
+	b1 := new(bytes.Buffer)
+	co.Reset(b1)
+	_, err = co.Write(input)
+	assert(t, err == nil)
+	assert(t, co.Close() == nil)
+	assert(t, bytes.Compare(b.Bytes(), b1.Bytes()) == 0)
+}
+
+func TestEffectiveRatio(t *testing.T) {
+	dict := randomBytes(10000, 26)
+	input := dict[2000:6000]
+
+	co := NewCompressor()
+	assert(t, co.EffectiveRatio(100) == -1)
+
+	b := new(bytes.Buffer)
+	co.SetWriter(b)
+	co.SetDictionary(&Dictionary{Dict: dict})
+	co.Write(input)
+	assert(t, co.Close() == nil)
+	assert(t, co.EffectiveRatio(0) == co.Ratio())
+	assert(t, co.EffectiveRatio(1000) == 10000*(b.Len()+1000)/len(input))
+	assert(t, co.EffectiveRatio(len(dict)) > 10000)
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	s := []byte("the quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dog")
+	f.Add(s, []byte("THE"+string(s)+"HELLO JOHN"+string(s)+"DOG"))
+	f.Add([]byte{}, bytes.Repeat([]byte{'a'}, 1000))
+	f.Add(randomBytes(1000, 27), append(randomBytes(1000, 27)[10:600], 'x'))
+	f.Add(bytes.Repeat([]byte("0123456789"), 30), bytes.Repeat([]byte("0123456789"), 40))
+
+	f.Fuzz(func(t *testing.T, dict, input []byte) {
+		for _, checksum := range []bool{false, true} {
+			b := new(bytes.Buffer)
+			co := NewCompressor()
+			co.SetWriter(b)
+			co.SetChecksum(checksum)
+			if err := co.SetDictionary(&Dictionary{Dict: dict}); err != nil {
+				t.Fatal(err)
+			}
+			co.Write(input)
+			if err := co.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// With everything buffered (no SetWindow or SetSpill)
+			// the output is never bigger than the input written as
+			// a single uncompressed section
+
+			limit := len(input) + binary.PutUvarint(make([]byte, 10), uint64(len(input)))
+			if checksum {
+				limit += 14
+			}
+			if len(input) > 0 && b.Len() > limit {
+				t.Fatalf("%d bytes compressed to %d", len(input), b.Len())
+			}
+
+			ex := NewExpander(bytes.NewReader(b.Bytes()), dict)
+			o, err := ex.Expand(make([]byte, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(o, input) {
+				t.Fatalf("round trip of %d bytes with a %d byte dictionary failed",
+					len(input), len(dict))
+			}
+		}
+	})
+}
+
+func TestNewExpanderFromDictionary(t *testing.T) {
+	d := BuildDictionary(randomBytes(5000, 28))
+	input := append(randomBytes(100, 29), d.Dict[1000:3000]...)
+
+	for _, dict := range []*Dictionary{d, nil} {
+		b := new(bytes.Buffer)
+		co := NewCompressor()
+		co.SetWriter(b)
+		if dict != nil {
+			co.SetDictionary(dict)
+		}
+		co.Write(input)
+		assert(t, co.Close() == nil)
+
+		ex := NewExpanderFromDictionary(bytes.NewReader(b.Bytes()), dict)
+		o, err := ex.Expand(make([]byte, 0))
+		assert(t, err == nil)
+		assert(t, bytes.Compare(o, input) == 0)
+	}
+}
+
+func TestExpandBounded(t *testing.T) {
+	dict := randomBytes(5000, 30)
+	input := append(randomBytes(300, 31), dict[1000:3000]...)
+	input = append(input, randomBytes(300, 32)...)
+
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.SetChecksum(true)
+	co.SetDictionary(&Dictionary{Dict: dict})
+	co.Write(input)
+	assert(t, co.Close() == nil)
+
+	// Exactly the right size
+
+	ex := NewExpander(bytes.NewReader(b.Bytes()), dict)
+	o, err := ex.ExpandBounded(make([]byte, 0, len(input)))
+	assert(t, err == nil)
+	assert(t, bytes.Compare(o, input) == 0)
+	assert(t, ex.InputOffset() == int64(b.Len()))
+
+	// Too small in the middle of a literal and of a reference, with
+	// expansion resumed with a bigger buffer
+
+	for _, size := range []int{100, 1000, len(input) - 1} {
+		ex = NewExpander(bytes.NewReader(b.Bytes()), dict)
+		o, err = ex.ExpandBounded(make([]byte, 0, size))
+		assert(t, err == io.ErrShortBuffer)
+		assert(t, len(o) == size)
+		assert(t, bytes.Compare(o, input[:size]) == 0)
+		assert(t, ex.InputOffset() < int64(b.Len()))
+
+		p := make([]byte, len(o), len(input))
+		copy(p, o)
+		o, err = ex.ExpandBounded(p)
+		assert(t, err == nil)
+		assert(t, bytes.Compare(o, input) == 0)
+		assert(t, ex.InputOffset() == int64(b.Len()))
+	}
+
+	// Errors found after the buffer is full are still reported
+
+	ex = NewExpander(bytes.NewReader(b.Bytes()[:b.Len()-1]), dict)
+	o, err = ex.ExpandBounded(make([]byte, 0, len(input)))
+	assert(t, err == io.ErrUnexpectedEOF)
+	assert(t, bytes.Compare(o, input) == 0)
+}
+
+func TestSectionCallback(t *testing.T) {
+	s := []byte("the quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dog")
+	s1 := string(s)
+	input := []byte("THE" + s1 + "HELLO JOHN" + s1 + "DOG")
+
+	type section struct {
+		kind           SectionKind
+		offset, length int
+	}
+	var sections []section
+
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.SetChecksum(true)
+	co.SetDictionary(&Dictionary{Dict: s})
+	co.SetSectionCallback(func(kind SectionKind, offset, length int) {
+		sections = append(sections, section{kind, offset, length})
+	})
+	co.Write(input)
+	assert(t, co.Close() == nil)
+
+	assert(t, len(sections) == 5)
+	assert(t, sections[0] == section{Literal, 0, 3})
+	assert(t, sections[1] == section{Reference, 3, 129})
+	assert(t, sections[2] == section{Literal, 132, 10})
+	assert(t, sections[3] == section{Reference, 142, 129})
+	assert(t, sections[4] == section{Literal, 271, 3})
+	assert(t, Literal.String() == "literal")
+	assert(t, Reference.String() == "reference")
+
+	// The output is the same without a callback
+
+	b1 := new(bytes.Buffer)
+	co.Reset(b1)
+	co.SetSectionCallback(nil)
+	co.Write(input)
+	assert(t, co.Close() == nil)
+	assert(t, bytes.Compare(b.Bytes(), b1.Bytes()) == 0)
+}
+
+func TestFinalBlock(t *testing.T) {
+	dict := randomBytes(200, 35)
+
+	// An input of exactly one block and an input whose last block
+	// is the only match
+
+	inputs := [][]byte{
+		dict[0:block],
+		append([]byte("HELLO"), dict[100:150]...),
+		append(append([]byte{}, dict[50:100]...), dict[100:150]...),
+	}
+	for _, input := range inputs {
+		b := new(bytes.Buffer)
+		co := NewCompressor()
+		co.SetWriter(b)
+		co.SetDictionary(&Dictionary{Dict: dict})
+		co.Write(input)
+		assert(t, co.Close() == nil)
+		refs, _ := co.Structure()
+		assert(t, refs == 1)
+
+		ex := NewExpander(bytes.NewReader(b.Bytes()), dict)
+		o, err := ex.Expand(make([]byte, 0))
+		assert(t, err == nil)
+		assert(t, bytes.Compare(o, input) == 0)
+	}
+
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.SetDictionary(&Dictionary{Dict: dict})
+	co.Write(dict[0:block])
+	assert(t, co.Close() == nil)
+	assert(t, bytes.Compare(b.Bytes(), []byte{0, 0, byte(block)}) == 0)
+}
+
+func TestContains(t *testing.T) {
+	d := &Dictionary{Dict: make([]byte, 100)}
+	assert(t, d.contains(0, 100, false) == nil)
+	assert(t, d.contains(50, 50, false) == nil)
+	err := d.contains(60, 50, false)
+	assert(t, err != nil)
+	assert(t, err.Error() == "reference [60,110) exceeds dictionary length 100")
+	err = d.contains(60, 50, true)
+	assert(t, err.Error() == "reference [60,110) exceeds input length 100")
+	assert(t, d.contains(1, 1<<64-1, false) != nil)
+
+	err = (&Dictionary{}).contains(0, 50, false)
+	assert(t, err.Error() == "reference written with an empty dictionary")
+}
+
+func TestWorstCase(t *testing.T) {
+	dict := randomBytes(100000, 37)
+	r := rand.New(rand.NewSource(38))
+
+	// Inputs with many short matches separated by short literals
+
+	for _, gap := range []int{1, 2, 10, 200} {
+		var input []byte
+		for len(input) < 50000 {
+			o := r.Intn(len(dict) - 100)
+			input = append(input, dict[o:o+50+r.Intn(3)]...)
+			input = append(input, randomBytes(gap, int64(len(input)))...)
+		}
+		for _, min := range []int{0, 60} {
+			b := new(bytes.Buffer)
+			co := NewCompressor()
+			co.SetWriter(b)
+			co.SetMinMatch(min)
+			co.SetDictionary(&Dictionary{Dict: dict})
+			co.Write(input)
+			assert(t, co.Close() == nil)
+			assert(t, b.Len() <= len(input)+3)
+		}
+	}
+}
+
+func TestStoredFallback(t *testing.T) {
+	dict := randomBytes(100000, 122)
+	r := rand.New(rand.NewSource(123))
+
+	// Short matches separated by a byte of random data, which in
+	// streaming modes are split at the end of the data buffered, and
+	// data that doesn't compress at all
+
+	var matches []byte
+	for len(matches) < 200000 {
+		o := r.Intn(len(dict) - 100)
+		matches = append(matches, dict[o:o+50+r.Intn(3)]...)
+		matches = append(matches, randomBytes(1, int64(len(matches)))...)
+	}
+	random := randomBytes(300000, 124)
+
+	dir := t.TempDir()
+	for _, input := range [][]byte{matches, random} {
+		for _, d := range [][]byte{dict, nil} {
+			for _, mode := range []string{"buffered", "window", "spill"} {
+				compress := func(stored bool) []byte {
+					b := new(bytes.Buffer)
+					co := NewCompressor()
+					co.SetWriter(b)
+					co.SetDictionary(&Dictionary{Dict: d})
+					co.SetStoredFallback(stored)
+					switch mode {
+					case "window":
+						co.SetWindow(100)
+					case "spill":
+						co.SetSpill(10000, dir)
+					}
+					for p := input; len(p) > 0; {
+						n := 1000
+						if n > len(p) {
+							n = len(p)
+						}
+						_, err := co.Write(p[:n])
+						assert(t, err == nil)
+						p = p[n:]
+					}
+					assert(t, co.Close() == nil)
+					assert(t, co.CanRoundTrip())
+					return b.Bytes()
+				}
+				out := compress(true)
+
+				// Streaming adds the length of an uncompressed
+				// section for every streamLookahead bytes at most
+
+				limit := len(input) + binary.PutUvarint(make([]byte, 10), uint64(len(input)))
+				if mode != "buffered" {
+					limit += 3 * (len(input) / streamLookahead)
+				}
+				if len(out) > limit {
+					t.Errorf("%s: %d bytes compressed to %d with a %d byte dictionary",
+						mode, len(input), len(out), len(d))
+				}
+				if mode == "window" && len(d) == 0 {
+					assert(t, len(compress(false)) > limit)
+				}
+
+				ex := NewExpander(bytes.NewReader(out), d)
+				n, err := ex.DecompressedSize()
+				assert(t, err == nil && n == len(input))
+				o, err := ex.Expand(make([]byte, 0))
+				assert(t, err == nil)
+				assert(t, bytes.Equal(o, input))
+
+				o, err = ioutil.ReadAll(NewExpander(bytes.NewReader(out), d))
+				assert(t, err == nil)
+				assert(t, bytes.Equal(o, input))
+
+				w := new(bytes.Buffer)
+				m, err := NewExpander(bytes.NewReader(out), d).WriteTo(w)
+				assert(t, err == nil && m == int64(len(input)))
+				assert(t, bytes.Equal(w.Bytes(), input))
+			}
+		}
+	}
+}
+
+func TestParams(t *testing.T) {
+	p := Params()
+	assert(t, p.Block == 50)
+	assert(t, p.Radix == 257)
+	assert(t, p.Prime == 1<<23)
+}
+
+// closeBuffer is a bytes.Buffer which records whether it was closed
+type closeBuffer struct {
+	bytes.Buffer
+	closed int
+}
+
+func (b *closeBuffer) Close() error {
+	b.closed++
+	return nil
+}
+
+func TestNewWriteCloser(t *testing.T) {
+	dict := randomBytes(5000, 39)
+	input := append(randomBytes(100, 40), dict[1000:3000]...)
+
+	b := new(closeBuffer)
+	wc := NewWriteCloser(b, &Dictionary{Dict: dict})
+	_, err := wc.Write(input)
+	assert(t, err == nil)
+	assert(t, b.Len() == 0)
+	assert(t, wc.Close() == nil)
+	assert(t, b.closed == 1)
+
+	o, err := Expand(nil, bytes.NewReader(b.Bytes()), dict)
+	assert(t, err == nil)
+	assert(t, bytes.Compare(o, input) == 0)
+
+	// A writer which isn't an io.Closer is left alone
+
+	b1 := new(bytes.Buffer)
+	wc = NewWriteCloser(b1, nil)
+	io.Copy(wc, bytes.NewReader(input))
+	assert(t, wc.Close() == nil)
+	o, err = Expand(nil, b1, nil)
+	assert(t, err == nil)
+	assert(t, bytes.Compare(o, input) == 0)
+
+	// The writer is still closed if the dictionary is bad
+
+	b = new(closeBuffer)
+	wc = NewWriteCloser(b, &Dictionary{Dict: dict[:10], H: BuildDictionary(dict).H})
+	_, err = wc.Write(input)
+	assert(t, err != nil)
+	assert(t, wc.Close() == err)
+	assert(t, b.closed == 1)
+}
+
+func TestBufferedBytes(t *testing.T) {
+	dict := randomBytes(5000, 41)
+
+	// Data is buffered until it is flushed, and without a dictionary
+	// it is kept after that
+
+	for _, d := range [][]byte{dict, nil} {
+		co := NewCompressor()
+		co.SetWriter(new(bytes.Buffer))
+		co.SetDictionary(&Dictionary{Dict: d})
+		assert(t, co.BufferedBytes() == 0)
+		co.Write(dict[:1000])
+		co.Write(dict[2000:3000])
+		assert(t, co.BufferedBytes() == 2000)
+		assert(t, co.Flush() == nil)
+		if d == nil {
+			assert(t, co.BufferedBytes() == 2000)
+		} else {
+			assert(t, co.BufferedBytes() == 0)
+		}
+		co.Reset(new(bytes.Buffer))
+		assert(t, co.BufferedBytes() == 0)
+	}
+}
+
+func TestSetWindow(t *testing.T) {
+	dict := randomBytes(100000, 42)
+	r := rand.New(rand.NewSource(43))
+
+	// Pieces of the dictionary, repeats of earlier input and random
+	// data
+
+	var input []byte
+	for len(input) < 1000000 {
+		switch r.Intn(3) {
+		case 0:
+			o := r.Intn(len(dict) - 2000)
+			input = append(input, dict[o:o+r.Intn(2000)]...)
+		case 1:
+			if len(input) > 5000 {
+				o := len(input) - 1 - r.Intn(5000)
+				input = append(input, input[o:o+r.Intn(len(input)-o)]...)
+			}
+		case 2:
+			input = append(input, randomBytes(r.Intn(500), int64(len(input)))...)
+		}
+	}
+
+	for _, d := range [][]byte{dict, nil} {
+		b := new(bytes.Buffer)
+		co := NewCompressor()
+		co.SetWriter(b)
+		co.SetDictionary(&Dictionary{Dict: d})
+		co.Write(input)
+		assert(t, co.Close() == nil)
+		whole := b.Len()
+
+		for _, window := range []int{1000, 10000, len(input)} {
+			for _, chunk := range []int{1, 100, 4096, 100000} {
+				if chunk == 1 && window != 1000 {
+					continue
+				}
+				b.Reset()
+				co.Reset(b)
+				co.SetWindow(window)
+				co.SetChecksum(true)
+				max := 0
+				for p := input; len(p) > 0; {
+					n := chunk
+					if n > len(p) {
+						n = len(p)
+					}
+					_, err := co.Write(p[:n])
+					assert(t, err == nil)
+					p = p[n:]
+					if co.BufferedBytes() > max {
+						max = co.BufferedBytes()
+					}
+				}
+
+				// Most of the output is written before Close and the
+				// memory used is bounded
+
+				assert(t, b.Len() > whole/2)
+				assert(t, max <= 2*(window+chunk+32*1024+100))
+				assert(t, co.Close() == nil)
+
+				// Without a dictionary a small window loses the
+				// repeats of the pieces of dict
+
+				if d != nil || window == len(input) {
+					assert(t, b.Len() < whole*11/10+1000)
+				} else {
+					assert(t, b.Len() < len(input))
+				}
+
+				ex := NewExpander(bytes.NewReader(b.Bytes()), d)
+				o, err := ex.Expand(make([]byte, 0))
+				assert(t, err == nil)
+				assert(t, bytes.Compare(o, input) == 0)
+			}
+		}
+		co.SetWindow(0)
+	}
+}
+
+func TestDeltaOffsets(t *testing.T) {
+	dict := randomBytes(1<<20, 57)
+
+	// An edited copy of the end of the dictionary has references with
+	// large but clustered offsets
+
+	input := similar(dict[len(dict)-100000:])
+	input = append(input, randomBytes(1000, 58)...)
+	input = append(input, input[:5000]...)
+
+	for _, d := range [][]byte{dict, nil} {
+		sizes := make([]int, 2)
+		for i, delta := range []bool{false, true} {
+			b := new(bytes.Buffer)
+			co := NewCompressor()
+			co.SetWriter(b)
+			co.SetDictionary(&Dictionary{Dict: d})
+			co.SetChecksum(true)
+			co.SetDeltaOffsets(delta)
+			co.Write(input[:50000])
+			assert(t, co.Flush() == nil)
+			co.Write(input[50000:])
+			assert(t, co.Close() == nil)
+			sizes[i] = b.Len()
+
+			ex := NewExpander(bytes.NewReader(b.Bytes()), d)
+			o, err := ex.Expand(make([]byte, 0))
+			assert(t, err == nil)
+			assert(t, bytes.Equal(o, input))
+
+			n, err := NewExpander(bytes.NewReader(b.Bytes()), d).DecompressedSize()
+			assert(t, err == nil)
+			assert(t, n == len(input))
+		}
+
+		// Without a dictionary there is only one reference so only
+		// the control section is added
+
+		if d != nil {
+			assert(t, sizes[1] < sizes[0])
+		} else {
+			assert(t, sizes[1] == sizes[0]+7)
+		}
+	}
+
+	// A relative offset which goes before the start of the dictionary
+	// is an error
+
+	_, err := Expand(nil, bytes.NewReader([]byte{0, 3, 0, 0, 0, 0, 0, 0, 1, 10}), dict)
+	assert(t, err != nil)
+	_, err = Expand(nil, bytes.NewReader([]byte{0, 3, 0, 0, 0, 0, 0, 0, 20, 10, 0, 19, 10}), dict)
+	assert(t, err == nil)
+}
+
+func TestEstimateCoverage(t *testing.T) {
+	dict := randomBytes(100000, 58)
+	d := BuildDictionary(dict)
+
+	assert(t, EstimateCoverage(dict[1000:51000], d) > 0.99)
+	assert(t, EstimateCoverage(randomBytes(50000, 59), d) < 0.01)
+	half := append(randomBytes(25000, 60), dict[3:25003]...)
+	c := EstimateCoverage(half, d)
+	assert(t, c > 0.49 && c < 0.51)
+
+	// The hash table is built if needed and the estimate is close to
+	// the fraction that is actually compressed
+
+	nd := &Dictionary{Dict: dict}
+	assert(t, EstimateCoverage(half, nd) == c)
+	assert(t, nd.H == nil)
+
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.SetDictionary(d)
+	co.Write(half)
+	assert(t, co.Close() == nil)
+	assert(t, b.Len() > 25000 && b.Len() < 25100)
+
+	assert(t, EstimateCoverage(dict[:10], d) == 0)
+	assert(t, EstimateCoverage(dict, &Dictionary{}) == 0)
+}
+
+func TestAdjacentMatches(t *testing.T) {
+	dict := randomBytes(10000, 59)
+	for _, gap := range []string{"", "X"} {
+
+		// The second region starts on a block boundary of the
+		// dictionary so it can only be found by checking the block
+		// that starts straight after the first match
+
+		input := append([]byte{}, dict[:1000]...)
+		input = append(input, gap...)
+		input = append(input, dict[2000:3000]...)
+
+		b := new(bytes.Buffer)
+		co := NewCompressor()
+		co.SetWriter(b)
+		co.SetDictionary(&Dictionary{Dict: dict})
+		co.Write(input)
+		assert(t, co.Close() == nil)
+		refs, literals := co.Structure()
+		assert(t, refs == 2)
+		assert(t, literals == len(gap))
+
+		ex := NewExpander(b, dict)
+		o, err := ex.Expand(make([]byte, 0))
+		assert(t, err == nil)
+		assert(t, bytes.Equal(o, input))
+	}
+}
+
+func TestAppendToBytes(t *testing.T) {
+	dict := randomBytes(10000, 60)
+	input := similar(dict[1000:9000])
+	b := new(bytes.Buffer)
+	_, err := Compress(b, input, &Dictionary{Dict: dict})
+	assert(t, err == nil)
+
+	// AppendTo keeps what is already in dst, Bytes returns just the
+	// decompressed data
+
+	o, err := NewExpander(bytes.NewReader(b.Bytes()), dict).AppendTo([]byte("prefix"))
+	assert(t, err == nil)
+	assert(t, bytes.Equal(o, append([]byte("prefix"), input...)))
+
+	o, err = NewExpander(bytes.NewReader(b.Bytes()), dict).Bytes()
+	assert(t, err == nil)
+	assert(t, bytes.Equal(o, input))
+
+	o, err = NewExpander(bytes.NewReader(nil), dict).Bytes()
+	assert(t, err == nil)
+	assert(t, len(o) == 0)
+}
+
+func TestDictionaryRegistry(t *testing.T) {
+	reg := DictionaryRegistry{
+		1: randomBytes(10000, 61),
+		2: randomBytes(10000, 62),
+	}
+
+	for id, dict := range reg {
+		input := similar(dict[2000:8000])
+		b := new(bytes.Buffer)
+		co := NewCompressor()
+		co.SetWriter(b)
+		co.SetDictionary(&Dictionary{Dict: dict})
+		co.SetDictionaryID(id)
+		co.SetChecksum(true)
+		co.Write(input)
+		assert(t, co.Close() == nil)
+		assert(t, b.Len() < len(input)/10)
+
+		o, err := NewExpanderWithRegistry(bytes.NewReader(b.Bytes()), reg).Bytes()
+		assert(t, err == nil)
+		assert(t, bytes.Equal(o, input))
+
+		// The id is ignored without a registry
+
+		o, err = NewExpander(bytes.NewReader(b.Bytes()), dict).Bytes()
+		assert(t, err == nil)
+		assert(t, bytes.Equal(o, input))
+
+		l, err := DebugDecode(bytes.NewReader(b.Bytes()))
+		assert(t, err == nil)
+		assert(t, strings.HasPrefix(l, fmt.Sprintf("DICTIONARY id=%d\nINTEGRITY", id)))
+
+		_, err = NewExpanderWithRegistry(bytes.NewReader(b.Bytes()), DictionaryRegistry{}).Bytes()
+		assert(t, err != nil)
+		assert(t, strings.Contains(err.Error(), "unknown dictionary id"))
+	}
+
+	// A stream without an id is expanded without a dictionary
+
+	input := bytes.Repeat([]byte("no dictionary "), 100)
+	b := new(bytes.Buffer)
+	_, err := Compress(b, input, nil)
+	assert(t, err == nil)
+	o, err := NewExpanderWithRegistry(b, reg).Bytes()
+	assert(t, err == nil)
+	assert(t, bytes.Equal(o, input))
+
+	// The id must come before any data
+
+	_, err = NewExpanderWithRegistry(bytes.NewReader([]byte{1, 'x', 0, 4, 0, 0, 0, 0, 1}), reg).Bytes()
+	assert(t, err != nil)
+}
+
+// emptyReader returns no data and no error from every other Read, and
+// from every Read once stall bytes have been read if stall is non-zero
+type emptyReader struct {
+	r     io.Reader
+	n     int
+	stall int
+	empty bool
+}
+
+func (r *emptyReader) Read(p []byte) (int, error) {
+	r.empty = !r.empty
+	if r.empty || r.stall > 0 && r.n >= r.stall {
+		return 0, nil
+	}
+	n, err := r.r.Read(p)
+	r.n += n
+	return n, err
+}
+
+func TestEmptyReads(t *testing.T) {
+	dict := randomBytes(10000, 62)
+	input := append(randomBytes(5000, 63), dict[:5000]...)
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.SetDictionary(&Dictionary{Dict: dict})
+	co.SetChecksum(true)
+	co.Write(input)
+	assert(t, co.Close() == nil)
+
+	o, err := NewExpander(&emptyReader{r: bytes.NewReader(b.Bytes())}, dict).Expand(make([]byte, 0))
+	assert(t, err == nil)
+	assert(t, bytes.Equal(o, input))
+
+	o, err = ioutil.ReadAll(NewExpander(iotest.OneByteReader(&emptyReader{r: bytes.NewReader(b.Bytes())}), dict))
+	assert(t, err == nil)
+	assert(t, bytes.Equal(o, input))
+
+	// A reader which never makes progress gives an error rather than
+	// truncated output
+
+	for _, stall := range []int{3, 2000, b.Len() - 2} {
+		_, err = NewExpander(&emptyReader{r: bytes.NewReader(b.Bytes()), stall: stall}, dict).Expand(make([]byte, 0))
+		assert(t, err == io.ErrNoProgress)
+		w := new(bytes.Buffer)
+		_, err = NewExpander(&emptyReader{r: bytes.NewReader(b.Bytes()), stall: stall}, dict).WriteTo(w)
+		assert(t, err == io.ErrNoProgress)
+	}
+}
+
+func TestExpandN(t *testing.T) {
+	dict := randomBytes(10000, 64)
+	input := append(randomBytes(3000, 65), dict[1000:6000]...)
+	input = append(input, "END"...)
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.SetDictionary(&Dictionary{Dict: dict})
+	co.Write(input)
+	assert(t, co.Close() == nil)
+	compressed := b.Len()
+
+	// Trailing data after the stream is not read
+
+	b.WriteString("trailer")
+	for _, step := range []int{1, 7, 1000, 4000, len(input)} {
+		r := bytes.NewReader(b.Bytes())
+		ex := NewExpander(r, dict)
+		var o []byte
+		var err error
+		for len(o) < len(input) {
+			n := step
+			if n > len(input)-len(o) {
+				n = len(input) - len(o)
+			}
+			o, err = ex.ExpandN(o, n)
+			assert(t, err == nil)
+		}
+		assert(t, bytes.Equal(o, input))
+		assert(t, ex.InputOffset() == int64(compressed))
+		assert(t, r.Len() == len("trailer"))
+	}
+
+	// Running out of stream is an error
+
+	o, err := NewExpander(bytes.NewReader(b.Bytes()[:compressed]), dict).ExpandN([]byte("x"), len(input)+1)
+	assert(t, err == io.ErrUnexpectedEOF)
+	assert(t, bytes.Equal(o[1:], input))
+}
+
+func TestExpandConsumed(t *testing.T) {
+	dict := randomBytes(10000, 64)
+	input := append(randomBytes(3000, 65), dict[1000:6000]...)
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.SetDictionary(&Dictionary{Dict: dict})
+	co.SetChecksum(true)
+	co.Write(input)
+	assert(t, co.Close() == nil)
+	compressed := b.Len()
+
+	// A stream followed by other data in the same message
+
+	b.WriteString("trailer")
+	r := bytes.NewReader(b.Bytes())
+	ex := NewExpander(io.LimitReader(r, int64(compressed)), dict)
+	o, consumed, err := ex.ExpandConsumed(nil)
+	assert(t, err == nil)
+	assert(t, bytes.Equal(o, input))
+	assert(t, consumed == compressed)
+	rest, _ := ioutil.ReadAll(r)
+	assert(t, string(rest) == "trailer")
+
+	// Only the bytes read by the call itself are counted
+
+	ex = NewExpander(bytes.NewReader(b.Bytes()[:compressed]), dict)
+	o, err = ex.ExpandN(nil, 100)
+	assert(t, err == nil)
+	before := int(ex.InputOffset())
+	assert(t, before > 0)
+	o, consumed, err = ex.ExpandConsumed(o)
+	assert(t, err == nil)
+	assert(t, bytes.Equal(o, input))
+	assert(t, consumed == compressed-before)
+
+	// A truncated stream reports what was read before the error
+
+	ex = NewExpander(bytes.NewReader(b.Bytes()[:compressed-2]), dict)
+	_, consumed, err = ex.ExpandConsumed(nil)
+	assert(t, err != nil)
+	assert(t, consumed == compressed-2)
+}
+
+func TestReferenceMarker(t *testing.T) {
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+
+	// An empty uncompressed block writes nothing rather than a zero
+	// length, and every section written starts with a non-zero length
+	// or the marker
+
+	assert(t, co.writeUncompressedBlock(nil) == nil)
+	assert(t, co.writeUncompressedBlock([]byte{}) == nil)
+	assert(t, b.Len() == 0)
+	_, literals := co.Structure()
+	assert(t, literals == 0)
+
+	assert(t, co.writeUncompressedBlock([]byte{0}) == nil)
+	assert(t, co.writeCompressedReference(5, 100) == nil)
+	assert(t, bytes.Equal(b.Bytes(), []byte{1, 0, referenceMarker, 5, 100}))
+}
+
+func TestExpandWith(t *testing.T) {
+	dicts := [][]byte{randomBytes(10000, 66), randomBytes(10000, 67), nil}
+	for i, dict := range dicts {
+		input := bytes.Repeat(randomBytes(100, int64(i)), 50)
+		if dict != nil {
+			input = append(input[:100], dict[2000:7000]...)
+		}
+		b := new(bytes.Buffer)
+		_, err := Compress(b, input, &Dictionary{Dict: dict})
+		assert(t, err == nil)
+
+		// The stream expands against the dictionary given and the
+		// Expander's own dictionary is not changed
+
+		ex := NewExpander(b, dicts[0])
+		o, err := ex.ExpandWith(make([]byte, 0), dict)
+		assert(t, err == nil)
+		assert(t, bytes.Equal(o, input))
+		assert(t, bytes.Equal(ex.dict, dicts[0]) && !ex.self)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	dict := randomBytes(10000, 68)
+	input := similar(dict)
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.SetDictionary(&Dictionary{Dict: dict})
+	co.Write(input)
+	assert(t, co.Metrics() == CompressionMetrics{})
+	assert(t, co.Close() == nil)
+
+	m := co.Metrics()
+	refs, literals := co.Structure()
+	hits, falsePositives := co.MatchStats()
+	assert(t, m.InputSize == len(input) && m.OutputSize == b.Len())
+	assert(t, m.RatioInt == co.Ratio())
+	assert(t, m.Ratio > 0 && m.Ratio < 0.1)
+	assert(t, m.References == refs && m.Literals == literals)
+	assert(t, m.Hits == hits && m.FalsePositives == falsePositives)
+	assert(t, m.References > 1)
+
+	co.Reset(b)
+	assert(t, co.Metrics() == CompressionMetrics{})
+	assert(t, co.Close() == nil)
+	assert(t, co.Metrics().RatioInt == -1 && co.Metrics().Ratio == 0)
+}
+
+func TestExpanderReaderAt(t *testing.T) {
+	dict := randomBytes(200000, 69)
+	input := append(randomBytes(1000, 70), dict[10000:150000]...)
+	input = append(input, similar(dict[:20000])...)
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.SetDictionary(&Dictionary{Dict: dict})
+	co.SetChecksum(true)
+	co.Write(input)
+	assert(t, co.Close() == nil)
+	compressed := b.Bytes()
+
+	ra := bytes.NewReader(dict)
+	o, err := NewExpanderReaderAt(bytes.NewReader(compressed), ra, int64(len(dict))).Expand(make([]byte, 0))
+	assert(t, err == nil)
+	assert(t, bytes.Equal(o, input))
+
+	w := new(bytes.Buffer)
+	_, err = NewExpanderReaderAt(bytes.NewReader(compressed), ra, int64(len(dict))).WriteTo(w)
+	assert(t, err == nil)
+	assert(t, bytes.Equal(w.Bytes(), input))
+
+	ex := NewExpanderReaderAt(bytes.NewReader(compressed), ra, int64(len(dict)))
+	n, err := ex.DecompressedSize()
+	assert(t, err == nil && n == len(input))
+	o = o[:0]
+	for len(o)+10007 < len(input) {
+		o, err = ex.ExpandN(o, 10007)
+		assert(t, err == nil)
+	}
+	o, err = ex.ExpandN(o, len(input)-len(o))
+	assert(t, err == nil)
+	assert(t, bytes.Equal(o, input))
+
+	// A dictionary which is shorter than its size or different from
+	// the one used to compress is detected
+
+	_, err = NewExpanderReaderAt(bytes.NewReader(compressed), bytes.NewReader(dict[:100000]), int64(len(dict))).Expand(make([]byte, 0))
+	assert(t, err != nil)
+	other := append([]byte{}, dict...)
+	other[0] ^= 1
+	_, err = NewExpanderReaderAt(bytes.NewReader(compressed), bytes.NewReader(other), int64(len(dict))).Expand(make([]byte, 0))
+	assert(t, err != nil)
+
+	// Without a dictionary references are to the output
+
+	b.Reset()
+	input = bytes.Repeat(randomBytes(1000, 71), 10)
+	_, err = Compress(b, input, nil)
+	assert(t, err == nil)
+	o, err = NewExpanderReaderAt(b, nil, 0).Expand(make([]byte, 0))
+	assert(t, err == nil)
+	assert(t, bytes.Equal(o, input))
+}
+
+func TestCloseVerify(t *testing.T) {
+	dict := randomBytes(10000, 72)
+	input := append(similar(dict), bytes.Repeat([]byte("abcdefghij"), 100)...)
+	for _, d := range [][]byte{dict, nil} {
+		b := new(bytes.Buffer)
+		co := NewCompressor()
+		co.SetWriter(b)
+		co.SetDictionary(&Dictionary{Dict: d})
+		co.SetChecksum(true)
+		co.Write(input)
+		assert(t, co.CloseVerify() == nil)
+		assert(t, co.CloseVerify() == ErrClosed)
+		compressed := append([]byte{}, b.Bytes()...)
+
+		o, err := NewExpander(b, d).Expand(make([]byte, 0))
+		assert(t, err == nil)
+		assert(t, bytes.Equal(o, input))
+
+		// Corrupted output fails verification
+
+		assert(t, co.checkRoundTrip(compressed, input) == nil)
+		for _, i := range []int{0, len(compressed) / 2, len(compressed) - 1} {
+			bad := append([]byte{}, compressed...)
+			bad[i] ^= 0x41
+			assert(t, co.checkRoundTrip(bad, input) != nil)
+		}
+		assert(t, co.checkRoundTrip(compressed[:len(compressed)-10], input) != nil)
+		assert(t, co.checkRoundTrip(compressed, input[1:]) != nil)
+
+		// A stream that has been flushed cannot be verified
+
+		co.Reset(b)
+		co.Write(input)
+		assert(t, co.Flush() == nil)
+		assert(t, co.CloseVerify() != nil)
+	}
+}
+
+func TestLengthHistograms(t *testing.T) {
+	dict := randomBytes(10000, 73)
+	input := append([]byte("THE"), dict[:1000]...)
+	input = append(input, "HELLO JOHN"...)
+	input = append(input, dict[5000:5200]...)
+	input = append(input, dict[2000:3000]...)
+	input = append(input, "DOG"...)
+
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.SetDictionary(&Dictionary{Dict: dict})
+	co.SetChecksum(true)
+	co.Write(input)
+	assert(t, co.Close() == nil)
+
+	refLens, litLens := co.LengthHistograms()
+	assert(t, len(refLens) == 2)
+	assert(t, refLens[1000] == 2 && refLens[200] == 1)
+	assert(t, len(litLens) == 2)
+	assert(t, litLens[3] == 2 && litLens[10] == 1)
+
+	// Each compression starts with empty histograms
+
+	co.Reset(b)
+	refLens, litLens = co.LengthHistograms()
+	assert(t, len(refLens) == 0 && len(litLens) == 0)
+	co.Write(input[:10])
+	assert(t, co.Close() == nil)
+	refLens, litLens = co.LengthHistograms()
+	assert(t, len(refLens) == 0)
+	assert(t, len(litLens) == 1 && litLens[10] == 1)
+}
+
+func TestBufferedExpander(t *testing.T) {
+	dict := randomBytes(10000, 74)
+	input := append(randomBytes(3000, 75), dict[1000:6000]...)
+	input = append(input, randomBytes(2000, 76)...)
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.SetDictionary(&Dictionary{Dict: dict})
+	co.SetChecksum(true)
+	co.Write(input)
+	assert(t, co.Close() == nil)
+
+	// The size of the rest of the stream can be found part way
+	// through a section of either kind, and the stream expanded again
+	// after rewinding
+
+	ex := NewBufferedExpander(b.Bytes(), dict)
+	for _, n := range []int{0, 1000, 5000, len(input)} {
+		assert(t, ex.Rewind() == nil)
+		o, err := ex.ExpandN(make([]byte, 0), n)
+		assert(t, err == nil)
+		size, err := ex.DecompressedSize()
+		assert(t, err == nil)
+		assert(t, size == len(input)-n)
+		o, err = ex.Expand(o)
+		assert(t, err == nil)
+		assert(t, bytes.Equal(o, input))
+	}
+
+	// The same works with an io.Reader, which is buffered, but it
+	// cannot be rewound
+
+	ex = NewExpander(bytes.NewReader(b.Bytes()), dict)
+	o, err := ex.ExpandN(make([]byte, 0), 1000)
+	assert(t, err == nil)
+	size, err := ex.DecompressedSize()
+	assert(t, err == nil && size == len(input)-1000)
+	o, err = ex.Expand(o)
+	assert(t, err == nil)
+	assert(t, bytes.Equal(o, input))
+	assert(t, ex.Rewind() != nil)
+}
+
+func TestMinCompressSize(t *testing.T) {
+	dict := randomBytes(10000, 77)
+	input := append([]byte("THE"), dict[:500]...)
+
+	for _, d := range [][]byte{dict, nil} {
+		in := input
+		if d == nil {
+			in = bytes.Repeat(input[:100], 5)
+		}
+		for _, min := range []int{0, len(in), len(in) + 1} {
+			b := new(bytes.Buffer)
+			co := NewCompressor()
+			co.SetWriter(b)
+			co.SetDictionary(&Dictionary{Dict: d})
+			co.SetMinCompressSize(min)
+			co.Write(in)
+			assert(t, co.Close() == nil)
+
+			// Only input shorter than the minimum is written as a
+			// single literal without looking for matches
+
+			refs, literals := co.Structure()
+			hits, _ := co.MatchStats()
+			if min > len(in) {
+				assert(t, refs == 0 && literals == 1 && hits == 0)
+				assert(t, b.Len() == len(in)+2)
+			} else {
+				assert(t, refs > 0)
+			}
+
+			o, err := NewExpander(b, d).Expand(make([]byte, 0))
+			assert(t, err == nil)
+			assert(t, bytes.Equal(o, in))
+		}
+	}
+}
+
+func TestCompressStream(t *testing.T) {
+	dict := randomBytes(10000, 78)
+	input := append(randomBytes(500, 79), dict[1000:8000]...)
+
+	for _, d := range [][]byte{dict, nil} {
+		var dictionary *Dictionary
+		if d != nil {
+			dictionary = BuildDictionary(d)
+		}
+
+		b := new(bytes.Buffer)
+		n, err := CompressStream(b, iotest.HalfReader(bytes.NewReader(input)), dictionary)
+		assert(t, err == nil)
+		assert(t, n == b.Len())
+
+		b1 := new(bytes.Buffer)
+		_, err = Compress(b1, input, dictionary)
+		assert(t, err == nil)
+		assert(t, bytes.Equal(b.Bytes(), b1.Bytes()))
+	}
+
+	_, err := CompressStream(new(bytes.Buffer), iotest.TimeoutReader(bytes.NewReader(input)), nil)
+	assert(t, err == iotest.ErrTimeout)
+	_, err = CompressStream(new(bytes.Buffer), bytes.NewReader(input),
+		&Dictionary{Dict: dict[:10], H: BuildDictionary(dict).H})
+	assert(t, err != nil)
+}
+
+func TestOverlappingReference(t *testing.T) {
+
+	// "ab" then a reference to it of length 9 repeats it, then a
+	// reference to the last byte repeats that
+
+	stream := []byte{2, 'a', 'b', 0, 0, 9, 1, 'c', 0, 11, 5}
+	want := []byte("abababababacccccc")
+	o, err := Expand(nil, bytes.NewReader(stream), nil)
+	assert(t, err == nil)
+	assert(t, bytes.Equal(o, want))
+
+	for _, n := range []int{1, 2, 3, 16} {
+		o, err = ioutil.ReadAll(iotest.OneByteReader(NewExpander(bytes.NewReader(stream), nil)))
+		assert(t, err == nil)
+		assert(t, bytes.Equal(o, want))
+
+		ex := NewExpander(bytes.NewReader(stream), nil)
+		o = o[:0]
+		for len(o)+n < len(want) {
+			o, err = ex.ExpandN(o, n)
+			assert(t, err == nil)
+		}
+		o, err = ex.ExpandN(o, len(want)-len(o))
+		assert(t, err == nil)
+		assert(t, bytes.Equal(o, want))
+	}
+
+	w := new(bytes.Buffer)
+	_, err = NewExpander(bytes.NewReader(stream), nil).WriteTo(w)
+	assert(t, err == nil)
+	assert(t, bytes.Equal(w.Bytes(), want))
+
+	size, err := NewExpander(bytes.NewReader(stream), nil).DecompressedSize()
+	assert(t, err == nil && size == len(want))
+
+	// A long run, and a reference which starts at the end of the
+	// output is still an error
+
+	long := []byte{1, 'x', 0, 0, 0x80, 0x80, 0x04}
+	o, err = Expand(nil, bytes.NewReader(long), nil)
+	assert(t, err == nil)
+	assert(t, bytes.Equal(o, bytes.Repeat([]byte{'x'}, 1+65536)))
+
+	_, err = Expand(nil, bytes.NewReader([]byte{1, 'x', 0, 1, 5}), nil)
+	assert(t, err != nil)
+}
+
+func TestRatioOverflow(t *testing.T) {
+	co := NewCompressor()
+	for _, c := range []struct {
+		out, in, ratio int
+	}{
+		{1, 3, 3333},
+		{2, 3, 6666},
+		{1 << 40, 1 << 41, 5000},
+		{maxInt / 2, maxInt, 4999},
+		{maxInt, maxInt, 10000},
+		{maxInt - 1, maxInt, 9999},
+		{maxInt, 1, maxInt},
+	} {
+		co.outSize, co.inSize = c.out, c.in
+		assert(t, co.Ratio() == c.ratio)
+		assert(t, co.RatioFloat() == float64(c.out)/float64(c.in))
+	}
+
+	co.inSize = 0
+	assert(t, co.Ratio() == -1 && co.RatioFloat() == -1)
+}
+
+func TestCanRoundTrip(t *testing.T) {
+	dict := randomBytes(10000, 78)
+	input := append(similar(dict), bytes.Repeat([]byte("0123456789"), 500)...)
+
+	for _, d := range [][]byte{dict, nil} {
+		for _, window := range []int{0, 1000} {
+			b := new(bytes.Buffer)
+			co := NewCompressor()
+			co.SetWriter(b)
+			co.SetDictionary(&Dictionary{Dict: d})
+			co.SetWindow(window)
+			co.SetChecksum(true)
+			co.Write(input[:5000])
+			assert(t, co.Flush() == nil)
+			co.Write(input[5000:])
+			assert(t, !co.CanRoundTrip())
+			assert(t, co.Close() == nil)
+			assert(t, co.CanRoundTrip())
+
+			co.Reset(b)
+			assert(t, !co.CanRoundTrip())
+		}
+
+		// A failed Close doesn't round trip
+
+		co := NewCompressor()
+		co.SetWriter(&shortWriter{max: 1000, limit: 50})
+		co.SetDictionary(&Dictionary{Dict: d})
+		co.Write(input)
+		assert(t, co.Close() != nil)
+		assert(t, !co.CanRoundTrip())
+	}
+}
+
+func TestSelfReferences(t *testing.T) {
+	dict := randomBytes(20000, 78)
+	d := BuildDictionary(dict)
+
+	// Data that isn't in the dictionary but is repeated can only be
+	// compressed against the input itself
+
+	fresh := randomBytes(5000, 79)
+	input := append(append([]byte{}, fresh...), dict[1000:6000]...)
+	input = append(input, fresh[100:4100]...)
+	input = append(input, dict[8000:9000]...)
+	input = append(input, fresh[:1000]...)
+
+	for _, delta := range []bool{false, true} {
+		for _, window := range []int{0, 100000, 2000} {
+			sizes := make([]int, 2)
+			var streams [2][]byte
+			for i, on := range []bool{false, true} {
+				b := new(bytes.Buffer)
+				co := NewCompressor()
+				co.SetWriter(b)
+				co.SetDictionary(d)
+				co.SetChecksum(true)
+				co.SetDeltaOffsets(delta)
+				co.SetSelfReferences(on)
+				if window > 0 {
+					co.SetWindow(window)
+				}
+				co.Write(input[:7000])
+				assert(t, co.Flush() == nil)
+				co.Write(input[7000:])
+				assert(t, co.Close() == nil)
+				sizes[i] = b.Len()
+				streams[i] = b.Bytes()
+
+				o, err := NewExpander(bytes.NewReader(b.Bytes()), dict).Expand(nil)
+				assert(t, err == nil)
+				assert(t, bytes.Equal(o, input))
+
+				o, err = NewExpanderReaderAt(bytes.NewReader(b.Bytes()), bytes.NewReader(dict), int64(len(dict))).Expand(nil)
+				assert(t, err == nil)
+				assert(t, bytes.Equal(o, input))
+
+				n, err := NewExpander(bytes.NewReader(b.Bytes()), dict).DecompressedSize()
+				assert(t, err == nil)
+				assert(t, n == len(input))
+			}
+
+			// A window too small to hold the repeats finds none
+			// of them
+
+			if window == 2000 {
+				assert(t, sizes[1] <= sizes[0]+7)
+			} else {
+				assert(t, sizes[1] < sizes[0]-3000)
+			}
+
+			listing, err := DebugDecode(bytes.NewReader(streams[1]))
+			assert(t, err == nil)
+			assert(t, strings.Contains(listing, "COMBINED\n"))
+		}
+	}
+
+	// Without a dictionary the stream is the same as without the
+	// option
+
+	var streams [2][]byte
+	for i, on := range []bool{false, true} {
+		b := new(bytes.Buffer)
+		co := NewCompressor()
+		co.SetWriter(b)
+		co.SetSelfReferences(on)
+		co.Write(input)
+		assert(t, co.Close() == nil)
+		streams[i] = b.Bytes()
+	}
+	assert(t, bytes.Equal(streams[0], streams[1]))
+
+	// Offsets past the end of the dictionary are positions in the
+	// output, which may overlap it, and the section can't come after
+	// output
+
+	short := []byte("abcdef")
+	o, err := Expand(nil, bytes.NewReader([]byte{0, 5, 0, 0, 0, 0, 0, 2, 'x', 'y', 0, 1, 3, 0, 10, 4}), short)
+	assert(t, err == nil)
+	assert(t, string(o) == "xybcddddd")
+	_, err = Expand(nil, bytes.NewReader([]byte{0, 5, 0, 0, 0, 0, 0, 2, 'x', 'y', 0, 9, 1}), short)
+	assert(t, err != nil)
+	_, err = Expand(nil, bytes.NewReader([]byte{2, 'x', 'y', 0, 5, 0, 0, 0, 0, 0}), short)
+	assert(t, err != nil)
+}
+
+// panicReader panics with x when it is read
+type panicReader struct {
+	x interface{}
+}
+
+func (r panicReader) Read(p []byte) (int, error) {
+	panic(r.x)
+}
+
+// fakeBoundsError looks like the runtime's error for an index out of
+// range, which a real out of range index doesn't produce when the
+// tests are built with bounds checks disabled (-gcflags=-B)
+type fakeBoundsError struct{}
+
+func (fakeBoundsError) RuntimeError() {}
+func (fakeBoundsError) Error() string { return "runtime error: index out of range [1] with length 0" }
+
+func TestExpanderPanics(t *testing.T) {
+
+	// An out of range error is turned into an error without output
+
+	recovered := func(f func()) (x interface{}) {
+		defer func() { x = recover() }()
+		f()
+		return
+	}
+	var bounds interface{} = fakeBoundsError{}
+	assert(t, isBoundsError(bounds))
+
+	o, err := NewExpander(panicReader{bounds}, nil).Expand([]byte("x"))
+	assert(t, errors.Is(err, errExpanderPanic))
+	assert(t, string(o) == "x")
+	_, err = NewExpander(panicReader{bounds}, nil).WriteTo(ioutil.Discard)
+	assert(t, errors.Is(err, errExpanderPanic))
+
+	// Anything else is a bug and is not recovered from
+
+	boom := errors.New("boom")
+	x := recovered(func() { NewExpander(panicReader{boom}, nil).Expand(nil) })
+	assert(t, x == boom)
+	x = recovered(func() { NewExpander(panicReader{boom}, nil).WriteTo(ioutil.Discard) })
+	assert(t, x == boom)
+	var m map[int]int
+	x = recovered(func() { m[0] = 1 })
+	_, ok := x.(runtime.Error)
+	assert(t, ok && !isBoundsError(x))
+}
+
+func TestCompressAppend(t *testing.T) {
+	dict := randomBytes(100000, 80)
+	input := similar(dict)
+
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.SetDictionary(BuildDictionary(dict))
+	co.SetChecksum(true)
+	co.Write(input)
+	assert(t, co.Close() == nil)
+
+	// The output is appended to whatever is in dst
+
+	o, err := co.CompressAppend([]byte("prefix"), input)
+	assert(t, err == nil)
+	assert(t, string(o[:6]) == "prefix")
+	assert(t, bytes.Equal(o[6:], b.Bytes()))
+	assert(t, co.CompressedSize() == b.Len())
+	assert(t, co.CanRoundTrip())
+
+	// The Compressor is left without a writer
+
+	_, err = co.Write(input)
+	assert(t, err == ErrNoWriter)
+
+	co.Grow(len(input))
+	dst := make([]byte, 0, len(input))
+	allocs := testing.AllocsPerRun(10, func() {
+		o, err = co.CompressAppend(dst, input)
+	})
+	assert(t, err == nil)
+	assert(t, allocs == 0)
+	assert(t, bytes.Equal(o, b.Bytes()))
+
+	e, err := Expand(nil, bytes.NewReader(o), dict)
+	assert(t, err == nil)
+	assert(t, bytes.Equal(e, input))
+}
+
+func TestDecodeAppend(t *testing.T) {
+	dict := randomBytes(50000, 81)
+	input := append(similar(dict), randomBytes(1000, 82)...)
+
+	for _, d := range [][]byte{dict, nil} {
+		co := NewCompressor()
+		co.SetDictionary(&Dictionary{Dict: d})
+		co.SetChecksum(true)
+		compressed, err := co.CompressAppend(nil, input)
+		assert(t, err == nil)
+
+		o, err := DecodeAppend([]byte("prefix"), compressed, d)
+		assert(t, err == nil)
+		assert(t, string(o[:6]) == "prefix")
+		assert(t, bytes.Equal(o[6:], input))
+		assert(t, cap(o) == len(o))
+
+		// A buffer large enough is used as it is
+
+		dst := make([]byte, 0, len(input)+10)
+		o, err = DecodeAppend(dst, compressed, d)
+		assert(t, err == nil)
+		assert(t, bytes.Equal(o, input))
+		assert(t, &o[0] == &dst[:1][0])
+
+		// Corrupt input gives the same error as Expand
+
+		_, want := Expand(nil, bytes.NewReader(compressed[:len(compressed)-1]), d)
+		_, err = DecodeAppend(nil, compressed[:len(compressed)-1], d)
+		assert(t, err != nil && err.Error() == want.Error())
+	}
+}
+
+func TestSubBlockInput(t *testing.T) {
+	dict := randomBytes(1000, 83)
+	tiny := dict[:int(block)-1]
+	for _, d := range [][]byte{nil, tiny, dict} {
+
+		// A dictionary shorter than a block has no blocks to hash
+
+		co := NewCompressor()
+		assert(t, co.SetDictionary(&Dictionary{Dict: d}) == nil)
+		if len(d) < int(block) {
+			assert(t, len(co.GetDictionary().H) == 0)
+		}
+
+		for _, n := range []int{0, 1, int(block) - 1, int(block), int(block) + 1} {
+			input := dict[100 : 100+n]
+			b := new(bytes.Buffer)
+			co.Reset(b)
+			co.Write(input)
+			assert(t, co.Close() == nil)
+
+			switch {
+			case n == 0:
+				assert(t, b.Len() == 0)
+				assert(t, co.Ratio() == -1)
+			case n < int(block):
+				assert(t, bytes.Equal(b.Bytes(), append([]byte{byte(n)}, input...)))
+				refs, literals := co.Structure()
+				assert(t, refs == 0 && literals == 1)
+			case len(d) == len(dict):
+				refs, _ := co.Structure()
+				assert(t, refs == 1)
+			}
+
+			o, err := Expand(nil, bytes.NewReader(b.Bytes()), d)
+			assert(t, err == nil)
+			assert(t, bytes.Equal(o, input))
+
+			// With a checksum empty input gives just the control sections
+
+			co.Reset(b)
+			b.Reset()
+			co.SetChecksum(true)
+			co.Write(input)
+			assert(t, co.Close() == nil)
+			co.SetChecksum(false)
+			if n == 0 {
+				assert(t, b.Len() == 14)
+			}
+			o, err = Expand(nil, bytes.NewReader(b.Bytes()), d)
+			assert(t, err == nil)
+			assert(t, bytes.Equal(o, input))
+		}
+	}
+
+	// Short pieces flushed between longer ones
+
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	input := append(append([]byte{}, dict[:500]...), "short"...)
+	co.Write(input[:500])
+	assert(t, co.Flush() == nil)
+	co.Write(input[500:])
+	assert(t, co.Flush() == nil)
+	co.Write(dict[:500])
+	assert(t, co.Close() == nil)
+	o, err := Expand(nil, bytes.NewReader(b.Bytes()), nil)
+	assert(t, err == nil)
+	assert(t, bytes.Equal(o, append(input, dict[:500]...)))
+	refs, _ := co.Structure()
+	assert(t, refs == 1)
+}
+
+func TestSetLogger(t *testing.T) {
+	dict := randomBytes(2000, 84)
+	input := append(randomBytes(100, 85), dict[500:1500]...)
+	input = append(input, dict[1700:1820]...)
+
+	var lines []string
+	logf := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.SetDictionary(&Dictionary{Dict: dict})
+	co.Write(input)
+	assert(t, co.Close() == nil)
+	want := b.String()
+
+	co.Reset(b)
+	b.Reset()
+	co.SetMinMatch(200)
+	co.SetLogger(logf)
+	co.Write(input)
+	assert(t, co.Close() == nil)
+	assert(t, len(lines) == 5)
+	assert(t, lines[0] == "bm: block at input offset 100 matches dictionary offset 500, extended backward 0 and forward 950 to 1000 bytes")
+	assert(t, lines[1] == "bm: block at input offset 1100 matches dictionary offset 1700, extended backward 0 and forward 70 to 120 bytes")
+	assert(t, lines[2] == "bm: match of 120 bytes is shorter than the minimum 200")
+
+	// A rejected match is found again from the next block
+
+	assert(t, strings.HasPrefix(lines[3], "bm: block at input offset 1150 matches dictionary offset 1750,"))
+
+	// The output is not affected
+
+	lines = nil
+	co.Reset(b)
+	b.Reset()
+	co.SetMinMatch(0)
+	co.Write(input)
+	assert(t, co.Close() == nil)
+	assert(t, b.String() == want)
+	assert(t, len(lines) == 2)
+
+	co.Reset(b)
+	co.Write(input[:10])
+	assert(t, co.Close() == nil)
+	assert(t, lines[2] == "bm: 10 bytes at input offset 0 written without searching for matches")
+
+	lines = nil
+	co.SetLogger(nil)
+	co.Reset(b)
+	co.Write(input)
+	assert(t, co.Close() == nil)
+	assert(t, len(lines) == 0)
+}
+
+func TestExpandNext(t *testing.T) {
+	dict := randomBytes(10000, 86)
+	objects := [][]byte{
+		similar(dict[:5000]),
+		{},
+		[]byte("short"),
+		append(randomBytes(3000, 87), randomBytes(3000, 87)...),
+	}
+
+	for _, d := range [][]byte{dict, nil} {
+		b := new(bytes.Buffer)
+		co := NewCompressor()
+		co.SetDictionary(&Dictionary{Dict: d})
+		co.SetEndMarker(true)
+		for i, o := range objects {
+			co.Reset(b)
+			co.SetChecksum(i%2 == 0)
+			co.SetDeltaOffsets(i == 3)
+			co.Write(o)
+			assert(t, co.Close() == nil)
+		}
+		b.WriteString("trailer")
+		stream := b.Bytes()
+
+		// Each object is expanded in turn and the reader is left at
+		// the start of the next
+
+		r := bytes.NewReader(stream)
+		ex := NewExpander(r, d)
+		for _, o := range objects {
+			q, err := ex.ExpandNext([]byte("x"))
+			assert(t, err == nil)
+			assert(t, bytes.Equal(q[1:], o))
+		}
+		assert(t, r.Len() == len("trailer"))
+
+		// Expand stops at the first marker
+
+		q, err := Expand(nil, bytes.NewReader(stream), d)
+		assert(t, err == nil)
+		assert(t, bytes.Equal(q, objects[0]))
+		n, err := NewExpander(bytes.NewReader(stream), d).DecompressedSize()
+		assert(t, err == nil)
+		assert(t, n == len(objects[0]))
+
+		// After the last object there are no more
+
+		r = bytes.NewReader(stream[:len(stream)-len("trailer")])
+		ex = NewExpander(r, d)
+		for range objects {
+			_, err = ex.ExpandNext(nil)
+			assert(t, err == nil)
+		}
+		q, err = ex.ExpandNext([]byte("x"))
+		assert(t, err == io.EOF)
+		assert(t, string(q) == "x")
+		_, err = ex.ExpandNext(nil)
+		assert(t, err == io.EOF)
+	}
+
+	// A stream without a marker is the last one
+
+	q, err := NewExpander(bytes.NewReader([]byte{5, 'h', 'e', 'l', 'l', 'o'}), nil).ExpandNext(nil)
+	assert(t, err == nil)
+	assert(t, string(q) == "hello")
+
+	// The marker can't come before the checksum
+
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.SetChecksum(true)
+	co.Write(objects[2])
+	assert(t, co.Close() == nil)
+	end := []byte{0, 6, 0, 0, 0, 0, 0}
+	broken := append(append(append([]byte{}, b.Bytes()[:b.Len()-7]...), end...), b.Bytes()[b.Len()-7:]...)
+	_, err = NewExpander(bytes.NewReader(broken), nil).ExpandNext(nil)
+	assert(t, err != nil && err != io.EOF)
+
+	listing, err := DebugDecode(bytes.NewReader(append(b.Bytes(), end...)))
+	assert(t, err == nil)
+	assert(t, strings.HasSuffix(listing, "\nEND\n"))
+}
+
+func TestExpanderReset(t *testing.T) {
+	dict := randomBytes(10000, 94)
+	other := randomBytes(10000, 95)
+	type object struct {
+		input, dict []byte
+		setup       func(co *Compressor)
+	}
+	objects := []object{
+		{similar(dict), dict, func(co *Compressor) {}},
+		{append(randomBytes(3000, 96), randomBytes(3000, 96)...), nil, func(co *Compressor) { co.SetChecksum(true) }},
+		{similar(other), other, func(co *Compressor) { co.SetDeltaOffsets(true) }},
+		{append(similar(dict), randomBytes(2000, 97)...), dict, func(co *Compressor) { co.SetSelfReferences(true) }},
+		{[]byte("tiny"), nil, func(co *Compressor) {}},
+	}
+	streams := make([][]byte, len(objects))
+	for i, o := range objects {
+		co := NewCompressor()
+		co.SetDictionary(&Dictionary{Dict: o.dict})
+		o.setup(co)
+		var err error
+		streams[i], err = co.CompressAppend(nil, o.input)
+		assert(t, err == nil)
+	}
+
+	// A corrupt stream part way through must not affect the next one
+
+	ex := NewBufferedExpander(streams[1][:len(streams[1])/2], nil)
+	_, err := ex.Expand(nil)
+	assert(t, err != nil)
+
+	for round := 0; round < 2; round++ {
+		for i, o := range objects {
+			ex.Reset(bytes.NewReader(streams[i]), o.dict)
+			q, err := ex.Expand(nil)
+			assert(t, err == nil)
+			assert(t, bytes.Equal(q, o.input))
+			want, _ := NewExpander(bytes.NewReader(streams[i]), o.dict).Expand(nil)
+			assert(t, bytes.Equal(q, want))
+			assert(t, ex.InputOffset() == int64(len(streams[i])))
+		}
+	}
+
+	// The Expander is no longer buffered
+
+	assert(t, ex.Rewind() != nil)
+}
+
+func TestSetSpill(t *testing.T) {
+	dir := t.TempDir()
+	dict := randomBytes(200000, 98)
+	input := similar(dict)
+	input = append(input, input[:50000]...)
+	files := func() int {
+		names, err := ioutil.ReadDir(dir)
+		assert(t, err == nil)
+		return len(names)
+	}
+
+	const spill = 64 << 10
+	for _, d := range [][]byte{dict, nil} {
+		b := new(bytes.Buffer)
+		co := NewCompressor()
+		co.SetWriter(b)
+		co.SetDictionary(&Dictionary{Dict: d})
+		co.SetWindow(spill)
+		co.Write(input)
+		assert(t, co.Close() == nil)
+		windowed := b.Len()
+
+		for _, write := range []string{"Write", "WriteString", "ReadFrom"} {
+			b.Reset()
+			co := NewCompressor()
+			co.SetWriter(b)
+			co.SetDictionary(&Dictionary{Dict: d})
+			co.SetChecksum(true)
+			co.SetSpill(spill, dir)
+			for p := input; len(p) > 0; {
+				n := 10000
+				if n > len(p) {
+					n = len(p)
+				}
+				switch write {
+				case "Write":
+					_, err := co.Write(p[:n])
+					assert(t, err == nil)
+				case "WriteString":
+					_, err := co.WriteString(string(p[:n]))
+					assert(t, err == nil)
+				case "ReadFrom":
+					_, err := co.ReadFrom(bytes.NewReader(p[:n]))
+					assert(t, err == nil)
+				}
+				p = p[n:]
+				assert(t, co.BufferedBytes() <= spill)
+			}
+			assert(t, files() == 1)
+			assert(t, co.CloseVerify() != nil)
+			assert(t, co.Close() == nil)
+			assert(t, files() == 0)
+			assert(t, co.CanRoundTrip())
+
+			o, err := Expand(nil, bytes.NewReader(b.Bytes()), d)
+			assert(t, err == nil)
+			assert(t, bytes.Equal(o, input))
+			assert(t, b.Len() <= windowed+100)
+		}
+	}
+
+	// Reset removes the file and Flush spills again afterwards
+
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.SetSpill(1000, dir)
+	co.Write(input[:5000])
+	assert(t, files() == 1)
+	co.Reset(b)
+	assert(t, files() == 0)
+	co.Write(input[:5000])
+	assert(t, co.Flush() == nil)
+	assert(t, files() == 0 && co.BufferedBytes() <= 5000)
+	co.Write(input[5000:10000])
+	assert(t, files() == 1)
+	assert(t, co.Close() == nil)
+	assert(t, files() == 0)
+	o, err := Expand(nil, bytes.NewReader(b.Bytes()), nil)
+	assert(t, err == nil)
+	assert(t, bytes.Equal(o, input[:10000]))
+
+	// Failing to create the file is an error from Write
+
+	co = NewCompressor()
+	co.SetWriter(b)
+	co.SetSpill(10, dir+"/missing")
+	_, err = co.Write(input[:100])
+	assert(t, err != nil)
+}
+
+func TestDictionaryExtremes(t *testing.T) {
+
+	// refs returns the offset and length of every reference in a
+	// compressed stream
+
+	refs := func(compressed []byte) (r [][2]int) {
+		listing, err := DebugDecode(bytes.NewReader(compressed))
+		assert(t, err == nil)
+		for _, line := range strings.Split(listing, "\n") {
+			var offset, length int
+			if n, _ := fmt.Sscanf(line, "REF offset=%d len=%d", &offset, &length); n == 2 {
+				r = append(r, [2]int{offset, length})
+			}
+		}
+		return
+	}
+
+	for _, size := range []int{1000, 1001, 1049, 1050} {
+		dict := randomBytes(size, 101)
+		junk := randomBytes(300, 102)
+
+		// The data before the start of the dictionary and after its
+		// end differs from junk, which stops the extension of matches
+		// at the very ends of the dictionary
+
+		inputs := [][]byte{
+			append(append(append([]byte{}, junk[:100]...), dict[:200]...), junk[100:200]...),
+			append(append(append([]byte{}, junk[:100]...), dict[size-175:]...), junk[100:200]...),
+			append(append([]byte{}, dict...), junk...),
+			append(append([]byte{}, junk...), dict...),
+		}
+		for i, input := range inputs {
+			b := new(bytes.Buffer)
+			co := NewCompressor()
+			co.SetWriter(b)
+			co.SetDictionary(&Dictionary{Dict: dict})
+			co.Write(input)
+			assert(t, co.Close() == nil)
+
+			r := refs(b.Bytes())
+			assert(t, len(r) == 1)
+			for _, ref := range r {
+				assert(t, ref[0]+ref[1] <= size)
+			}
+
+			// All of the matching content is found.  The last block of
+			// the dictionary is not hashed when it ends exactly at the
+			// end but a match runs into it from the one before.
+
+			switch i {
+			case 0:
+				assert(t, r[0] == [2]int{0, 200})
+			case 1:
+				assert(t, r[0] == [2]int{size - 175, 175})
+			default:
+				assert(t, r[0] == [2]int{0, size})
+			}
+
+			o, err := Expand(nil, bytes.NewReader(b.Bytes()), dict)
+			assert(t, err == nil)
+			assert(t, bytes.Equal(o, input))
+		}
+	}
+}
+
+func TestCompressorCompress(t *testing.T) {
+	dict := randomBytes(100000, 103)
+	co := NewCompressor()
+	co.SetDictionary(BuildDictionary(dict))
+	co.SetChecksum(true)
+
+	var outputs [][]byte
+	for _, input := range [][]byte{similar(dict), randomBytes(1000, 104), nil} {
+		o, err := co.Compress(input)
+		assert(t, err == nil)
+		assert(t, len(o) == cap(o))
+		assert(t, len(o) == co.CompressedSize())
+		want, _ := co.CompressAppend(nil, input)
+		assert(t, bytes.Equal(o, want))
+		outputs = append(outputs, o)
+
+		e, err := Expand(nil, bytes.NewReader(o), dict)
+		assert(t, err == nil)
+		assert(t, bytes.Equal(e, input))
+	}
+
+	// Each output is independent of the buffer reused for the next
+
+	want, _ := co.CompressAppend(nil, similar(dict))
+	assert(t, bytes.Equal(outputs[0], want))
+
+	input := similar(dict)
+	co.Grow(len(input))
+	co.Compress(input)
+	allocs := testing.AllocsPerRun(10, func() {
+		co.Compress(input)
+	})
+	assert(t, allocs == 1)
+}
+
+func TestExpanderWindow(t *testing.T) {
+	r := rand.New(rand.NewSource(110))
+
+	// Repeats of recent input, long runs and random data compressed
+	// without a dictionary in a window
+
+	var input []byte
+	for len(input) < 1000000 {
+		switch r.Intn(3) {
+		case 0:
+			if len(input) > 5000 {
+				o := len(input) - 1 - r.Intn(5000)
+				input = append(input, input[o:o+r.Intn(len(input)-o)]...)
+			}
+		case 1:
+			input = append(input, bytes.Repeat([]byte{byte(r.Intn(256))}, r.Intn(20000))...)
+		case 2:
+			input = append(input, randomBytes(r.Intn(500), int64(len(input)))...)
+		}
+	}
+
+	const window = 10000
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.SetWindow(window)
+	co.SetChecksum(true)
+	co.Write(input)
+	assert(t, co.Close() == nil)
+	refs, _ := co.Structure()
+	assert(t, refs > 100)
+
+	ex := NewExpander(bytes.NewReader(b.Bytes()), nil)
+	ex.SetWindow(window)
+	o, err := ex.Expand(nil)
+	assert(t, err == nil)
+	assert(t, bytes.Equal(o, input))
+	assert(t, cap(ex.d) < 8*window)
+	assert(t, ex.base > uint64(len(input)-4*window))
+
+	// Reading a little at a time and writing everything out keep the
+	// output bounded too
+
+	ex.Reset(bytes.NewReader(b.Bytes()), nil)
+	o, err = ioutil.ReadAll(iotest.OneByteReader(ex))
+	assert(t, err == nil)
+	assert(t, bytes.Equal(o, input))
+	assert(t, cap(ex.d) < 8*window)
+
+	ex.Reset(bytes.NewReader(b.Bytes()), nil)
+	w := new(bytes.Buffer)
+	_, err = ex.WriteTo(w)
+	assert(t, err == nil)
+	assert(t, bytes.Equal(w.Bytes(), input))
+	assert(t, cap(ex.d) < 8*window)
+
+	// A run much longer than the window repeats the data before it
+
+	long := []byte{3, 'x', 'y', 'z', 0, 1, 0x80, 0x89, 0x7a}
+	ex = NewExpander(bytes.NewReader(long), nil)
+	ex.SetWindow(100)
+	o, err = ex.Expand(nil)
+	assert(t, err == nil)
+	assert(t, bytes.Equal(o, append([]byte("x"), bytes.Repeat([]byte("yz"), 1000001)...)))
+	assert(t, len(ex.d) <= 200)
+
+	// A reference to the output before the window is an error
+
+	stream := append([]byte{0x80, 0x02}, randomBytes(256, 111)...)
+	stream = append(stream, 0, 10, 10)
+	ex = NewExpander(bytes.NewReader(stream), nil)
+	ex.SetWindow(100)
+	_, err = ex.Expand(nil)
+	assert(t, err != nil && strings.Contains(err.Error(), "before the last 100 bytes"))
+	o, err = Expand(nil, bytes.NewReader(stream), nil)
+	assert(t, err == nil && len(o) == 266)
+}
+
+func TestSetBackwardExtension(t *testing.T) {
+	dict := randomBytes(1000, 112)
+	d := BuildDictionary(dict)
+
+	// The input starts 40 bytes before the block of the dictionary at
+	// 50, which is found and extended back to the start unless that is
+	// disabled
+
+	input := dict[10:500]
+	for _, on := range []bool{true, false} {
+		co := NewCompressor()
+		co.SetDictionary(d)
+		co.SetBackwardExtension(on)
+		o, err := co.CompressAppend(nil, input)
+		assert(t, err == nil)
+		refs, literals := co.Structure()
+		assert(t, refs == 1)
+		if on {
+			assert(t, literals == 0)
+			assert(t, bytes.Equal(o, []byte{0, 10, 0xea, 0x03}))
+		} else {
+			assert(t, literals == 1)
+			assert(t, bytes.Equal(o[:41], append([]byte{40}, dict[10:50]...)))
+			assert(t, bytes.Equal(o[41:], []byte{0, 50, 0xc2, 0x03}))
+		}
+
+		e, err := Expand(nil, bytes.NewReader(o), dict)
+		assert(t, err == nil)
+		assert(t, bytes.Equal(e, input))
+	}
+}
+
+func TestErrorKinds(t *testing.T) {
+	dict := randomBytes(1000, 113)
+	expand := func(stream, dict []byte) error {
+		_, err := Expand(nil, bytes.NewReader(stream), dict)
+		return err
+	}
+
+	err := expand([]byte{3, 'a', 'b', 'c', 0, 0xe0, 0x07, 10}, dict)
+	assert(t, errors.Is(err, ErrCorruptStream))
+	assert(t, errors.Is(err, ErrReferenceOutOfBounds))
+	assert(t, !errors.Is(err, ErrDictionaryMismatch))
+
+	err = expand([]byte{0, 5, 1}, nil)
+	assert(t, errors.Is(err, ErrCorruptStream) && errors.Is(err, ErrReferenceOutOfBounds))
+
+	err = expand([]byte{0, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x02, 1}, dict)
+	assert(t, errors.Is(err, ErrCorruptStream) && errors.Is(err, ErrMalformedVarint))
+
+	err = expand([]byte{0, 99, 0, 0, 0, 0, 0}, dict)
+	assert(t, errors.Is(err, ErrCorruptStream))
+	_, err = NewBufferedExpander([]byte{0, 99, 0, 0, 0, 0, 0}, dict).DecompressedSize()
+	assert(t, errors.Is(err, ErrCorruptStream))
+	_, err = DebugDecode(bytes.NewReader([]byte{0, 99, 0, 0, 0, 0, 0}))
+	assert(t, errors.Is(err, ErrCorruptStream))
+	_, err = NewBufferedExpander([]byte{0, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x02, 1}, dict).DecompressedSize()
+	assert(t, errors.Is(err, ErrCorruptStream) && errors.Is(err, ErrMalformedVarint))
+	huge := []byte{0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}
+	_, err = NewBufferedExpander(append(append([]byte{}, huge...), huge...), dict).DecompressedSize()
+	assert(t, errors.Is(err, ErrCorruptStream))
+
+	// Truncation is reported as such rather than as corruption
+
+	err = expand([]byte{0, 5}, dict)
+	assert(t, err == io.ErrUnexpectedEOF)
+
+	// Expanding with the wrong dictionary
+
+	co := NewCompressor()
+	co.SetDictionary(BuildDictionary(dict))
+	co.SetChecksum(true)
+	o, err := co.CompressAppend(nil, dict[100:200])
+	assert(t, err == nil)
+	err = expand(o, randomBytes(1000, 114))
+	assert(t, errors.Is(err, ErrCorruptStream) && errors.Is(err, ErrDictionaryMismatch))
+
+	stream := append([]byte{0, byte(ctrlDictionaryID), 0, 0, 0, 0, 7}, o...)
+	ex := NewExpanderWithRegistry(bytes.NewReader(stream), DictionaryRegistry{1: dict})
+	_, err = ex.Expand(nil)
+	assert(t, errors.Is(err, ErrDictionaryMismatch))
+
+	err = co.SetDictionary(BuildDictionaryBlock(dict, 40))
+	assert(t, errors.Is(err, ErrDictionaryMismatch))
+	err = co.SetDictionary(&Dictionary{Dict: dict[:10], H: BuildDictionary(dict).H})
+	assert(t, errors.Is(err, ErrDictionaryMismatch))
+	err = co.SetDictionary(&Dictionary{Dict: dict[:10], H64: map[uint32]uint64{1: 5}})
+	assert(t, errors.Is(err, ErrDictionaryMismatch))
+
+	// The Compressor's check of references before they are written
+
+	err = (&Dictionary{Dict: dict}).contains(990, 20, false)
+	assert(t, errors.Is(err, ErrReferenceOutOfBounds))
+	err = (&Dictionary{}).contains(0, 1, false)
+	assert(t, errors.Is(err, ErrReferenceOutOfBounds))
+
+	co = NewCompressor()
+	_, err = co.Write([]byte("x"))
+	assert(t, err == ErrNoWriter)
+}
+
+func TestSetLengthPrefix(t *testing.T) {
+	dict := randomBytes(10000, 118)
+	inputs := [][]byte{similar(dict), nil, randomBytes(500, 119), dict[1000:3000]}
+
+	// Several self-delimiting streams one after the other, followed by
+	// other data
+
+	co := NewCompressor()
+	co.SetDictionary(BuildDictionary(dict))
+	co.SetLengthPrefix(true)
+	co.SetChecksum(true)
+	all := new(bytes.Buffer)
+	for _, input := range inputs {
+		o, err := co.Compress(input)
+		assert(t, err == nil)
+		l, n := binary.Uvarint(o)
+		assert(t, n > 0 && int(l) == len(o)-n)
+		assert(t, co.CompressedSize() == len(o))
+
+		co.SetLengthPrefix(false)
+		p, _ := co.Compress(input)
+		co.SetLengthPrefix(true)
+		assert(t, bytes.Equal(o[n:], p))
+
+		all.Write(o)
+	}
+	all.WriteString("trailer")
+
+	r := bytes.NewReader(all.Bytes())
+	ex := NewLengthPrefixedExpander(r, dict)
+	for _, input := range inputs {
+		o, err := ex.Expand(nil)
+		assert(t, err == nil)
+		assert(t, bytes.Equal(o, input))
+		ex.Reset(r, dict)
+	}
+	rest, _ := ioutil.ReadAll(r)
+	assert(t, string(rest) == "trailer")
+
+	// CloseVerify understands the prefix, and it can't be written once
+	// the stream has been started
+
+	b := new(bytes.Buffer)
+	co.Reset(b)
+	co.Write(inputs[0])
+	assert(t, co.CloseVerify() == nil)
+
+	b.Reset()
+	co.Reset(b)
+	co.Write(inputs[0])
+	assert(t, co.Flush() == nil)
+	assert(t, co.Close() != nil)
+
+	// A stream shorter than its length, a malformed length and a
+	// length which cuts a section short
+
+	o, _ := co.Compress(inputs[2])
+	_, err := NewLengthPrefixedExpander(bytes.NewReader(o[:len(o)-1]), dict).Expand(nil)
+	assert(t, err == io.ErrUnexpectedEOF)
+	_, err = NewLengthPrefixedExpander(bytes.NewReader(bytes.Repeat([]byte{0xff}, 11)), dict).Expand(nil)
+	assert(t, errors.Is(err, ErrCorruptStream) && errors.Is(err, ErrMalformedVarint))
+	_, err = NewLengthPrefixedExpander(bytes.NewReader([]byte{3, 5, 'a', 'b', 'c', 'd', 'e'}), nil).Expand(nil)
+	assert(t, err == io.ErrUnexpectedEOF)
+	o, err = NewLengthPrefixedExpander(bytes.NewReader(nil), nil).Expand(nil)
+	assert(t, err == nil && len(o) == 0)
+}
+
+func TestSetMaxInputSize(t *testing.T) {
+	input := randomBytes(10000, 120)
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.SetMaxInputSize(len(input))
+
+	// Writing up to the limit is fine, past it nothing is buffered
+
+	n, err := co.Write(input[:6000])
+	assert(t, n == 6000 && err == nil)
+	n, err = co.Write(input[6000:])
+	assert(t, n == 4000 && err == nil)
+	n, err = co.Write([]byte{1})
+	assert(t, n == 0 && err == ErrInputTooLarge)
+	n, err = co.WriteString("x")
+	assert(t, n == 0 && err == ErrInputTooLarge)
+	assert(t, co.BufferedBytes() == len(input))
+	assert(t, co.Close() == nil)
+	assert(t, co.InputSize() == len(input))
+	o, err := Expand(nil, bytes.NewReader(b.Bytes()), nil)
+	assert(t, err == nil && bytes.Equal(o, input))
+
+	// The limit applies to each stream and a single Write may not
+	// cross it
+
+	b.Reset()
+	co.Reset(b)
+	n, err = co.Write(append(input, 0))
+	assert(t, n == 0 && err == ErrInputTooLarge)
+	assert(t, co.BufferedBytes() == 0 && co.InputSize() == 0)
+
+	// ReadFrom stops at the limit without buffering more than it, but
+	// input that is exactly the limit is fine
+
+	for _, extra := range []int{0, 1, 50000} {
+		b.Reset()
+		co.Reset(b)
+		src := append(append([]byte{}, input...), randomBytes(extra, 121)...)
+		total, err := co.ReadFrom(bytes.NewReader(src))
+		if extra == 0 {
+			assert(t, err == nil && total == int64(len(input)))
+		} else {
+			assert(t, err == ErrInputTooLarge && total <= int64(len(input)))
+		}
+		assert(t, co.BufferedBytes() <= len(input))
+		assert(t, co.InputSize() == int(total))
+	}
+
+	// Zero is unlimited
+
+	co.SetMaxInputSize(0)
+	co.Reset(b)
+	n, err = co.Write(append(input, input...))
+	assert(t, n == 2*len(input) && err == nil)
+}
@@ -0,0 +1,125 @@
+// debug.go: human readable listing of a compressed stream
+//
+// Copyright (c) 2012-2013 CloudFlare, Inc.
+
+package bm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// debugLiteral is the number of bytes of each uncompressed section
+// that DebugDecode shows
+const debugLiteral = 32
+
+// DebugDecode reads the compressed stream from r and returns a listing
+// of its sections, one per line, for diagnosing how data was
+// compressed.  For example:
+//
+//	LITERAL(3) "THE"
+//	REF offset=0 len=129
+//
+// Reference offsets are shown as absolute offsets even if the stream
+// was written with SetDeltaOffsets.  Only the first few bytes of long
+// uncompressed sections are shown.  No dictionary is needed since
+// references are not resolved.  If the stream is corrupt the listing
+// up to that point is returned with the error.
+func DebugDecode(r io.Reader) (string, error) {
+	e := NewExpander(r, nil)
+	var out bytes.Buffer
+	var delta bool
+	var prev uint64
+
+	for {
+		u, err := e.readVarUint()
+		if err == io.EOF {
+			return out.String(), nil
+		}
+		if err != nil {
+			return out.String(), err
+		}
+
+		if u != referenceMarker {
+
+			// io.CopyN would take a length this large as negative and
+			// skip nothing
+
+			if u > math.MaxInt64 {
+				return out.String(), errorf(ErrCorruptStream, "uncompressed section length %d is too large", u)
+			}
+			shown := u
+			if shown > debugLiteral {
+				shown = debugLiteral
+			}
+			buf := make([]byte, shown)
+			if _, err := io.ReadFull(e.r, buf); err != nil {
+				return out.String(), unexpected(err)
+			}
+			if _, err := io.CopyN(ioutil.Discard, e.r, int64(u-shown)); err != nil {
+				return out.String(), unexpected(err)
+			}
+
+			more := ""
+			if shown < u {
+				more = "..."
+			}
+			fmt.Fprintf(&out, "LITERAL(%d) %q%s\n", u, buf, more)
+			continue
+		}
+
+		var v [2]uint64
+		for i := range v {
+			if v[i], err = e.readVarUint(); err != nil {
+				return out.String(), unexpected(err)
+			}
+		}
+
+		if v[1] != 0 {
+			if delta {
+				v[0] = prev + unzigzag(v[0])
+				prev = v[0] + v[1]
+			}
+			fmt.Fprintf(&out, "REF offset=%d len=%d\n", v[0], v[1])
+			continue
+		}
+
+		var payload [4]byte
+		if _, err := io.ReadFull(e.r, payload[:]); err != nil {
+			return out.String(), unexpected(err)
+		}
+		sum := binary.BigEndian.Uint32(payload[:])
+
+		switch v[0] {
+		case ctrlIntegrity:
+			fmt.Fprintf(&out, "INTEGRITY dictionary crc=%08x\n", sum)
+		case ctrlChecksum:
+			fmt.Fprintf(&out, "CHECKSUM crc=%08x\n", sum)
+		case ctrlDictionaryID:
+			fmt.Fprintf(&out, "DICTIONARY id=%d\n", sum)
+		case ctrlDelta:
+			delta = true
+			prev = 0
+			fmt.Fprintf(&out, "DELTA\n")
+		case ctrlCombined:
+			fmt.Fprintf(&out, "COMBINED\n")
+		case ctrlEnd:
+			fmt.Fprintf(&out, "END\n")
+		default:
+			return out.String(), errorf(ErrCorruptStream, "unknown control section %d", v[0])
+		}
+	}
+}
+
+// unexpected: converts io.EOF into io.ErrUnexpectedEOF for data that
+// is missing part way through a section
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
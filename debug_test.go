@@ -0,0 +1,81 @@
+// debug_test.go: tests for the stream listing
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package bm
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestDebugDecode(t *testing.T) {
+	s := []byte("the quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dog")
+	s1 := string(s)
+	input := []byte("THE" + s1 + "HELLO JOHN" + s1 + "DOG")
+
+	b := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(b)
+	co.SetDictionary(&Dictionary{Dict: s})
+	co.Write(input)
+	assert(t, co.Close() == nil)
+
+	l, err := DebugDecode(bytes.NewReader(b.Bytes()))
+	assert(t, err == nil)
+	assert(t, l == `LITERAL(3) "THE"
+REF offset=0 len=129
+LITERAL(10) "HELLO JOHN"
+REF offset=0 len=129
+LITERAL(3) "DOG"
+`)
+
+	// Long literals are shortened and control sections are shown
+
+	b.Reset()
+	co.Reset(b)
+	co.SetChecksum(true)
+	co.Write(bytes.Repeat([]byte{'x'}, 40))
+	assert(t, co.Close() == nil)
+	l, err = DebugDecode(bytes.NewReader(b.Bytes()))
+	assert(t, err == nil)
+	assert(t, l == `INTEGRITY dictionary crc=2706e778
+LITERAL(40) "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"...
+CHECKSUM crc=c41a71f0
+`)
+
+	// Relative offsets are listed as absolute ones
+
+	b.Reset()
+	co.Reset(b)
+	co.SetChecksum(false)
+	co.SetDeltaOffsets(true)
+	co.SetDictionary(&Dictionary{Dict: s})
+	co.Write(input)
+	assert(t, co.Close() == nil)
+	l, err = DebugDecode(bytes.NewReader(b.Bytes()))
+	assert(t, err == nil)
+	assert(t, l == `DELTA
+LITERAL(3) "THE"
+REF offset=0 len=129
+LITERAL(10) "HELLO JOHN"
+REF offset=0 len=129
+LITERAL(3) "DOG"
+`)
+
+	// A truncated stream gives what was decoded before the error
+
+	l, err = DebugDecode(bytes.NewReader([]byte{3, 'T', 'H', 'E', 0, 1}))
+	assert(t, err == io.ErrUnexpectedEOF)
+	assert(t, l == "LITERAL(3) \"THE\"\n")
+
+	// As does an uncompressed section too long to skip
+
+	huge := []byte{3, 'T', 'H', 'E', 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}
+	huge = append(huge, bytes.Repeat([]byte{'x'}, debugLiteral)...)
+	l, err = DebugDecode(bytes.NewReader(huge))
+	assert(t, errors.Is(err, ErrCorruptStream))
+	assert(t, l == "LITERAL(3) \"THE\"\n")
+}
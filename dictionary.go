@@ -0,0 +1,537 @@
+// dictionary.go: construction of dictionaries independently of a
+// Compressor
+//
+// Copyright (c) 2012-2013 CloudFlare, Inc.
+
+package bm
+
+import (
+	"io"
+	"sort"
+	"sync"
+)
+
+// BuildDictionary creates a Dictionary from data with the hash table
+// already computed so that it can be built in advance (and cached)
+// and passed to SetDictionary without any further work.
+func BuildDictionary(data []byte) *Dictionary {
+	return BuildDictionaryBlock(data, block)
+}
+
+// BuildDictionaryBlock is like BuildDictionary but fingerprints
+// blocks of size bytes rather than the default block size. size must
+// be greater than zero.
+func BuildDictionaryBlock(data []byte, size uint32) *Dictionary {
+	d := &Dictionary{Dict: data}
+	d.build(newRabinKarp(size), size)
+	return d
+}
+
+// BuildDictionaryMax is like BuildDictionary but the hash table is
+// limited to at most max entries (see Dictionary.MaxEntries).
+func BuildDictionaryMax(data []byte, max int) *Dictionary {
+	d := &Dictionary{Dict: data, MaxEntries: max}
+	d.build(newRabinKarp(block), block)
+	return d
+}
+
+// BuildDictionaryCandidates is like BuildDictionary but keeps up to n
+// positions for each fingerprint (see Dictionary.Candidates).
+func BuildDictionaryCandidates(data []byte, n int) *Dictionary {
+	d := &Dictionary{Dict: data, Candidates: n}
+	d.build(newRabinKarp(block), block)
+	return d
+}
+
+// BuildDictionarySecondary is like BuildDictionary but also keeps a
+// secondary fingerprint of each block (see Dictionary.Secondary).
+func BuildDictionarySecondary(data []byte) *Dictionary {
+	d := &Dictionary{Dict: data, Secondary: true}
+	d.build(newRabinKarp(block), block)
+	return d
+}
+
+// BuildDictionaryParallel is like BuildDictionary but splits the
+// hashing of data across up to workers goroutines, which is faster
+// for very large dictionaries on machines with several cores.  The
+// hash table is identical to the one built by BuildDictionary.  With
+// fewer than two workers this is the same as BuildDictionary.
+func BuildDictionaryParallel(data []byte, workers int) *Dictionary {
+	if workers < 2 {
+		return BuildDictionary(data)
+	}
+
+	// The blocks are non-overlapping so splitting the data on block
+	// boundaries means that no block straddles two chunks.  As in
+	// build, a block which ends at the very end of data is not hashed.
+
+	blk := uint64(block)
+	var blocks uint64
+	if len(data) > 0 {
+		blocks = (uint64(len(data)) - 1) / blk
+	}
+	per := (blocks + uint64(workers) - 1) / uint64(workers)
+
+	// Each worker computes the fingerprints of its blocks and the
+	// hash table is filled in afterwards
+
+	sums := make([]uint32, blocks)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		first := uint64(w) * per
+		last := first + per
+		if last > blocks {
+			last = blocks
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h := newRabinKarp(block)
+			for k := first; k < last; k++ {
+				h.Reset()
+				for _, b := range data[k*blk : (k+1)*blk] {
+					h.Prime(b)
+				}
+				sums[k] = h.Sum()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Adding the blocks in order keeps the first position at which
+	// each fingerprint was seen
+
+	d := &Dictionary{Dict: data, Block: block}
+	if d.wide() {
+		d.H64 = make(map[uint32]uint64)
+	} else {
+		d.H = make(map[uint32]uint32)
+	}
+	for k, f := range sums {
+		d.add(f, uint64(k)*blk)
+	}
+	return d
+}
+
+// MergeDictionaries returns a dictionary whose Dict is a.Dict followed
+// by b.Dict.  The hash tables of a and b are reused (with the
+// positions of b moved along by the length of a.Dict) rather than
+// rebuilt, and the fingerprint at the end of a which wasn't hashed is
+// hashed together with the start of b so that matches can start there
+// and run into b.  Where both have the same fingerprint the position
+// in a is kept.  A hash table built for a different block size (see
+// Dictionary.Block) cannot be reused so it is rebuilt instead.  Only
+// Dict, H and H64 are merged; a and b are not modified.
+func MergeDictionaries(a, b *Dictionary) *Dictionary {
+	blk := uint64(block)
+	dict := make([]byte, 0, len(a.Dict)+len(b.Dict))
+	dict = append(append(dict, a.Dict...), b.Dict...)
+	d := &Dictionary{Dict: dict, Block: block}
+	if d.wide() || a.wide() || b.wide() {
+		d.H64 = make(map[uint32]uint64, len(a.H)+len(a.H64)+len(b.H)+len(b.H64))
+	} else {
+		d.H = make(map[uint32]uint32, len(a.H)+len(b.H))
+	}
+
+	// A dictionary without a hash table, or with one for another
+	// block size, has it built as SetDictionary would
+
+	table := func(x *Dictionary) *Dictionary {
+		if (x.H == nil && x.H64 == nil) || (x.Block != 0 && x.Block != block) {
+			return BuildDictionary(x.Dict)
+		}
+		return x
+	}
+	a, b = table(a), table(b)
+
+	for f, p := range a.H {
+		d.add(f, uint64(p))
+	}
+	for f, p := range a.H64 {
+		d.add(f, p)
+	}
+
+	// The blocks of a which were not hashed because they reach its end
+	// are hashed now that they are followed by b
+
+	n := uint64(len(a.Dict))
+	var p uint64
+	if n > 0 {
+		p = (n - 1) / blk * blk
+	}
+	h := newRabinKarp(block)
+	for ; p < n && p+blk < uint64(len(dict)); p += blk {
+		h.Reset()
+		for _, c := range dict[p : p+blk] {
+			h.Prime(c)
+		}
+		d.add(h.Sum(), p)
+	}
+
+	for f, p := range b.H {
+		d.add(f, n+uint64(p))
+	}
+	for f, p := range b.H64 {
+		d.add(f, n+p)
+	}
+	return d
+}
+
+// TrainDictionary builds a dictionary of at most maxSize bytes from
+// samples of the data that will be compressed against it.  It is a
+// heuristic: the blocks at every position of every sample are
+// fingerprinted and counted (once per sample), and then the most
+// common blocks which appear in at least two samples are added to the
+// dictionary in order of how common they are.  Each block added is
+// extended in its sample for as long as the blocks overlapping it are
+// also common, so that whole pieces of common data are added and
+// matches against the dictionary can be extended beyond one block.
+func TrainDictionary(samples [][]byte, maxSize int) *Dictionary {
+	blk := int(block)
+
+	// A block is represented by its first occurrence
+
+	type occurrence struct {
+		sample, pos int
+	}
+	counts := make(map[uint32]int)
+	first := make(map[uint32]occurrence)
+	for s, sample := range samples {
+		seen := make(map[uint32]bool)
+		h := newRabinKarp(block)
+		for i := 0; i <= len(sample); i++ {
+			if i < blk {
+				if i < len(sample) {
+					h.Prime(sample[i])
+				}
+				continue
+			}
+			f := h.Sum()
+			if !seen[f] {
+				seen[f] = true
+				counts[f]++
+				if _, ok := first[f]; !ok {
+					first[f] = occurrence{s, i - blk}
+				}
+			}
+			if i < len(sample) {
+				h.Roll(sample[i-blk], sample[i])
+			}
+		}
+	}
+
+	var common []uint32
+	for f, n := range counts {
+		if n > 1 {
+			common = append(common, f)
+		}
+	}
+	sort.Slice(common, func(i, j int) bool {
+		a, b := common[i], common[j]
+		if counts[a] != counts[b] {
+			return counts[a] > counts[b]
+		}
+		oa, ob := first[a], first[b]
+		if oa.sample != ob.sample {
+			return oa.sample < ob.sample
+		}
+		return oa.pos < ob.pos
+	})
+
+	rk := newRabinKarp(block)
+	fingerprint := func(p []byte) uint32 {
+		rk.Reset()
+		for _, b := range p {
+			rk.Prime(b)
+		}
+		return rk.Sum()
+	}
+
+	var dict []byte
+	used := make(map[uint32]bool)
+	for _, f := range common {
+		if len(dict)+blk > maxSize {
+			break
+		}
+		if used[f] {
+			continue
+		}
+
+		// The block is extended a byte at a time in both directions
+		// while the blocks overlapping it are also common
+
+		o := first[f]
+		sample := samples[o.sample]
+		frequent := func(p []byte) bool {
+			g := fingerprint(p)
+			return counts[g] > 1 && !used[g]
+		}
+		start, end := o.pos, o.pos+blk
+		for len(dict)+end-start < maxSize {
+			if end < len(sample) && frequent(sample[end-blk+1:end+1]) {
+				end++
+			} else if start > 0 && frequent(sample[start-1:start-1+blk]) {
+				start--
+			} else {
+				break
+			}
+		}
+
+		// Every block in the piece added can now be matched so none
+		// of them need to be added again
+
+		for i := start; i+blk <= end; i++ {
+			used[fingerprint(sample[i:i+blk])] = true
+		}
+		dict = append(dict, sample[start:end]...)
+	}
+
+	return BuildDictionary(dict)
+}
+
+// build computes the hash table for d.Dict by fingerprinting every
+// non-overlapping block of size bytes with rh and storing the
+// position of the first time each fingerprint is seen.
+func (d *Dictionary) build(rh RollingHash, size uint32) {
+	if d.wide() {
+		d.H = nil
+		d.H64 = make(map[uint32]uint64)
+	} else {
+		d.H = make(map[uint32]uint32)
+		d.H64 = nil
+	}
+	d.Extra = nil
+	if d.Candidates > 1 {
+		d.Extra = make(map[uint32][]uint64)
+	}
+	d.H2 = nil
+	if d.Secondary {
+		d.H2 = make(map[uint32]SecondaryEntry)
+	}
+
+	h := newHasher(d, rh, size)
+	h.hash()
+}
+
+// A hasher incrementally computes the hash table of a Dictionary
+// whose Dict is growing. Each call to hash fingerprints the bytes
+// added to Dict since the last call.
+type hasher struct {
+	d   *Dictionary
+	h   RollingHash // Holds the fingerprint of the block ending at i
+	blk uint64
+	i   uint64 // Position in d.Dict up to which hashing has been done
+
+	// When d.MaxEntries is set the fingerprints in the hash table are
+	// kept in the order they were added so that the oldest can be
+	// evicted.  This is a ring buffer starting at oldest.
+
+	order  []uint32
+	oldest int
+}
+
+// newHasher creates a hasher for the dictionary d whose hash table
+// has already been allocated and is empty
+func newHasher(d *Dictionary, rh RollingHash, size uint32) *hasher {
+	rh.Reset()
+	d.Block = size
+	return &hasher{d: d, h: rh, blk: uint64(size)}
+}
+
+// hash fingerprints any bytes added to the dictionary since the last
+// call
+func (h *hasher) hash() {
+	d := h.d.Dict
+	step := h.d.stride(uint32(h.blk))
+	for ; h.i < uint64(len(d)); h.i++ {
+		i := h.i
+
+		if i < h.blk {
+			h.h.Prime(d[i])
+		} else {
+			if (i-h.blk)%step == 0 {
+				h.add(h.h.Sum(), i-h.blk)
+			}
+
+			h.h.Roll(d[i-h.blk], d[i])
+		}
+	}
+}
+
+// add records the block with fingerprint f at position p, evicting
+// the oldest block first if the hash table is full.  A fingerprint
+// that has already been seen is only recorded if more candidate
+// positions are being kept.
+func (h *hasher) add(f uint32, p uint64) {
+	if _, exists := h.d.lookup(f); exists {
+		if x := h.d.Extra; x != nil && len(x[f]) < h.d.Candidates-1 {
+			x[f] = append(x[f], p)
+		}
+		return
+	}
+
+	if max := h.d.MaxEntries; max > 0 {
+		if len(h.order) < max {
+			h.order = append(h.order, f)
+		} else {
+			old := h.order[h.oldest]
+			delete(h.d.H, old)
+			delete(h.d.H64, old)
+			delete(h.d.Extra, old)
+			delete(h.d.H2, old)
+			h.order[h.oldest] = f
+			h.oldest = (h.oldest + 1) % max
+		}
+	}
+	h.d.add(f, p)
+	if h.d.H2 != nil {
+		h.d.H2[f] = SecondaryEntry{p, secondary(h.d.Dict[p : p+h.blk])}
+	}
+}
+
+// SetDictionaryFromReader sets the dictionary to the contents of r.
+// The hash table is computed as the data is read and the bytes are
+// read directly into the dictionary so that there is no need to read
+// the entire dictionary into memory first.  The dictionary is left
+// unchanged if r returns an error.
+func (c *Compressor) SetDictionaryFromReader(r io.Reader) error {
+	d := Dictionary{H: make(map[uint32]uint32)}
+	h := newHasher(&d, c.h, block)
+
+	for {
+		if len(d.Dict) == cap(d.Dict) {
+			d.Dict = append(d.Dict, make([]byte, 32*1024)...)[:len(d.Dict)]
+		}
+
+		n, err := r.Read(d.Dict[len(d.Dict):cap(d.Dict)])
+		d.Dict = d.Dict[:len(d.Dict)+n]
+		h.hash()
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	c.dict = d
+	return nil
+}
+
+// A DictionaryBuilder builds a Dictionary from data which arrives in
+// pieces, such as sample objects read one at a time.  The hash table
+// is computed as each piece is added, with blocks that straddle two
+// pieces hashed correctly, so the result is the same as calling
+// BuildDictionary on all the pieces concatenated.
+type DictionaryBuilder struct {
+	d *Dictionary
+	h *hasher
+}
+
+// NewDictionaryBuilder creates an empty DictionaryBuilder
+func NewDictionaryBuilder() *DictionaryBuilder {
+	b := &DictionaryBuilder{}
+	b.reset()
+	return b
+}
+
+// reset starts a new, empty dictionary
+func (b *DictionaryBuilder) reset() {
+	b.d = &Dictionary{H: make(map[uint32]uint32)}
+	b.h = newHasher(b.d, newRabinKarp(block), block)
+}
+
+// Add appends p to the dictionary being built and hashes it.  p is
+// copied and may be reused by the caller.
+func (b *DictionaryBuilder) Add(p []byte) {
+	b.d.Dict = append(b.d.Dict, p...)
+	b.h.hash()
+}
+
+// Len returns the number of bytes added so far
+func (b *DictionaryBuilder) Len() int {
+	return len(b.d.Dict)
+}
+
+// Finish returns the dictionary built from everything added so far.
+// The builder is then empty and can be used to build another
+// dictionary.
+func (b *DictionaryBuilder) Finish() *Dictionary {
+	d := b.d
+	b.reset()
+	return d
+}
+
+// Evaluate compresses each of samples against d, with the default
+// options, and returns the total size of the samples and of their
+// compressed streams and the ratio of the two as Ratio does (so that
+// larger samples carry more weight), for comparing how well candidate
+// dictionaries suit a set of samples.  A single Compressor is used
+// for all the samples.  The ratio is -1, and the totals are zero, if
+// d cannot be used (see SetDictionary) or a sample fails to compress;
+// it is also -1 if there are no samples.  d is not modified.
+func (d *Dictionary) Evaluate(samples [][]byte) (avgRatio int, totalIn, totalOut int) {
+	co := NewCompressor()
+	if co.SetDictionary(d) != nil {
+		return -1, 0, 0
+	}
+
+	var o []byte
+	var err error
+	for _, s := range samples {
+		if o, err = co.CompressAppend(o[:0], s); err != nil {
+			return -1, 0, 0
+		}
+		totalIn += len(s)
+		totalOut += len(o)
+	}
+	if totalIn == 0 {
+		return -1, totalIn, totalOut
+	}
+	return ratio(totalOut, totalIn), totalIn, totalOut
+}
+
+// A DictionaryContext holds a Dictionary whose hash table has been
+// built, together with the precomputed tables of the rolling hash, so
+// that many objects can be compressed against the same dictionary
+// cheaply.  It is never modified after it is created and so can be
+// used from multiple goroutines at once.
+type DictionaryContext struct {
+	dict Dictionary
+	h    rabinKarp
+}
+
+// NewDictionaryContext creates a DictionaryContext for d, building its
+// hash table if it has not already been built.  d must not be modified
+// afterwards.  An error is returned if d is inconsistent (see
+// SetDictionary).
+func NewDictionaryContext(d *Dictionary) (*DictionaryContext, error) {
+	if err := d.check(block); err != nil {
+		return nil, err
+	}
+
+	x := &DictionaryContext{dict: *d, h: *newRabinKarp(block)}
+	if d.H == nil && d.H64 == nil {
+		x.dict.build(&x.h, block)
+	}
+	return x, nil
+}
+
+// NewCompressor returns a Compressor which writes to w and compresses
+// against the context's dictionary.  The Compressor shares the
+// dictionary with the context rather than copying it.
+func (x *DictionaryContext) NewCompressor(w io.Writer) *Compressor {
+	h := x.h
+	c := NewCompressorWithHash(&h)
+	c.SetWriter(w)
+	c.dict = x.dict
+	return c
+}
+
+// NewExpander returns an Expander which reads compressed data from r
+// and expands it using the context's dictionary.
+func (x *DictionaryContext) NewExpander(r io.Reader) *Expander {
+	return NewExpander(r, x.dict.Dict)
+}
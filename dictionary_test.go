@@ -0,0 +1,654 @@
+// dictionary_test.go: tests for dictionary construction
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package bm
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+	"testing"
+	"testing/iotest"
+)
+
+func TestBuildDictionary(t *testing.T) {
+	s := []byte("the quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dog")
+	d := BuildDictionary(s)
+	assert(t, d != nil)
+	assert(t, bytes.Compare(d.Dict, s) == 0)
+	assert(t, len(d.H) == 2)
+
+	// The prebuilt hash table must be identical to the one that
+	// SetDictionary computes itself
+
+	co := NewCompressor()
+	co.SetDictionary(&Dictionary{Dict: s})
+	assert(t, len(co.GetDictionary().H) == len(d.H))
+	for k, v := range co.GetDictionary().H {
+		assert(t, d.H[k] == v)
+	}
+
+	b := new(bytes.Buffer)
+	co = NewCompressor()
+	co.SetWriter(b)
+	co.SetDictionary(d)
+	co.Write(s)
+	assert(t, co.Close() == nil)
+	assert(t, b.Len() == 4)
+
+	d = BuildDictionaryBlock(s, 10)
+	assert(t, len(d.H) == 12)
+	for _, v := range d.H {
+		assert(t, v%10 == 0)
+	}
+}
+
+func TestSetDictionaryFromReader(t *testing.T) {
+	s := []byte("the quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dog")
+	big := bytes.Repeat(s, 1000)
+	d := BuildDictionary(big)
+
+	co := NewCompressor()
+	err := co.SetDictionaryFromReader(iotest.HalfReader(bytes.NewReader(big)))
+	assert(t, err == nil)
+	assert(t, bytes.Compare(co.GetDictionary().Dict, big) == 0)
+	assert(t, len(co.GetDictionary().H) == len(d.H))
+	for k, v := range co.GetDictionary().H {
+		assert(t, d.H[k] == v)
+	}
+
+	b := new(bytes.Buffer)
+	co.SetWriter(b)
+	co.Write(s)
+	assert(t, co.Close() == nil)
+	assert(t, b.Len() == 4)
+
+	// A read error leaves the existing dictionary in place
+
+	err = co.SetDictionaryFromReader(iotest.TimeoutReader(bytes.NewReader(s)))
+	assert(t, err == iotest.ErrTimeout)
+	assert(t, len(co.GetDictionary().Dict) == len(big))
+}
+
+func TestSharedDictionary(t *testing.T) {
+	s := []byte("the quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dog")
+	s1 := string(s)
+	input := []byte("THE" + s1 + "HELLO JOHN" + s1 + "DOG")
+
+	// One dictionary with a prebuilt hash table and one which each
+	// Compressor will need to build for itself
+
+	for _, d := range []*Dictionary{BuildDictionary(s), &Dictionary{Dict: s}} {
+		var wg sync.WaitGroup
+		results := make([][]byte, 16)
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				b := new(bytes.Buffer)
+				co := NewCompressor()
+				co.SetWriter(b)
+				co.SetDictionary(d)
+				co.Write(input)
+				if co.Close() == nil {
+					results[i] = b.Bytes()
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		for _, r := range results {
+			assert(t, len(r) == 27)
+			assert(t, bytes.Compare(r, results[0]) == 0)
+		}
+	}
+}
+
+func TestMaxEntries(t *testing.T) {
+	dict := randomBytes(10000, 18)
+	full := BuildDictionary(dict)
+	assert(t, len(full.H) == 199)
+
+	// Only the 20 most recent blocks are kept
+
+	d := BuildDictionaryMax(dict, 20)
+	assert(t, len(d.H) == 20)
+	for _, p := range d.H {
+		assert(t, p >= 9900-20*50)
+	}
+
+	co := NewCompressor()
+	co.SetDictionary(&Dictionary{Dict: dict, MaxEntries: 20})
+	assert(t, len(co.GetDictionary().H) == 20)
+	for k, v := range co.GetDictionary().H {
+		assert(t, d.H[k] == v)
+	}
+
+	// Data from the start of the dictionary can no longer be matched
+	// but data from the end can
+
+	for _, input := range [][]byte{dict[:2000], dict[9000:]} {
+		b := new(bytes.Buffer)
+		co.Reset(b)
+		co.Write(input)
+		assert(t, co.Close() == nil)
+		if input[0] == dict[0] {
+			assert(t, b.Len() > len(input))
+		} else {
+			assert(t, b.Len() < 20)
+		}
+
+		ex := NewExpander(bytes.NewReader(b.Bytes()), dict)
+		o, err := ex.Expand(make([]byte, 0))
+		assert(t, err == nil)
+		assert(t, bytes.Compare(o, input) == 0)
+	}
+}
+
+func TestBuildDictionaryParallel(t *testing.T) {
+	dict := append(randomBytes(100000, 19), randomBytes(100000, 19)...)
+	dict = append(dict, randomBytes(1234, 20)...)
+
+	for _, n := range []int{0, 49, 50, 51, 101, 5000, len(dict)} {
+		serial := BuildDictionary(dict[:n])
+		for _, workers := range []int{0, 1, 2, 3, 7, 64} {
+			d := BuildDictionaryParallel(dict[:n], workers)
+			assert(t, len(d.H) == len(serial.H))
+			for k, v := range serial.H {
+				assert(t, d.H[k] == v)
+			}
+		}
+	}
+}
+
+func TestDictionaryBuilder(t *testing.T) {
+	dict := append(randomBytes(10000, 19), randomBytes(333, 20)...)
+	serial := BuildDictionary(dict)
+
+	// Pieces of every size, including empty ones and ones smaller
+	// than a block, must give the same hash table
+
+	for _, size := range []int{1, 7, 49, 50, 51, 1000, len(dict)} {
+		b := NewDictionaryBuilder()
+		b.Add(nil)
+		for p := dict; len(p) > 0; {
+			n := size
+			if n > len(p) {
+				n = len(p)
+			}
+			piece := append([]byte{}, p[:n]...)
+			b.Add(piece)
+			for i := range piece {
+				piece[i] = 0
+			}
+			p = p[n:]
+		}
+		assert(t, b.Len() == len(dict))
+		d := b.Finish()
+		assert(t, bytes.Equal(d.Dict, dict))
+		assert(t, len(d.H) == len(serial.H))
+		for k, v := range serial.H {
+			assert(t, d.H[k] == v)
+		}
+
+		// The builder starts again after Finish
+
+		assert(t, b.Len() == 0)
+		b.Add(dict[:500])
+		assert(t, len(b.Finish().H) == len(BuildDictionary(dict[:500]).H))
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	a := randomBytes(50, 22)
+	b := randomBytes(1000, 23)
+	var dict []byte
+	dict = append(dict, a...)
+	dict = append(dict, randomBytes(450, 24)...)
+	dict = append(dict, a...)
+	dict = append(dict, b...)
+	dict = append(dict, randomBytes(100, 25)...)
+	input := append(append([]byte{}, a...), b...)
+
+	d := BuildDictionaryCandidates(dict, 4)
+	assert(t, len(d.H) == len(BuildDictionary(dict).H))
+	assert(t, len(d.Extra) == 1)
+	for f, x := range d.Extra {
+		assert(t, d.H[f] == 0)
+		assert(t, len(x) == 1 && x[0] == 500)
+	}
+
+	// The earliest copy of the first block doesn't extend into the
+	// rest of the input and the later one does
+
+	refs := []int{}
+	for _, dictionary := range []*Dictionary{BuildDictionary(dict), d,
+		&Dictionary{Dict: dict, Candidates: 4}} {
+		out := new(bytes.Buffer)
+		co := NewCompressor()
+		co.SetWriter(out)
+		assert(t, co.SetDictionary(dictionary) == nil)
+		co.Write(input)
+		assert(t, co.Close() == nil)
+		r, _ := co.Structure()
+		refs = append(refs, r)
+
+		ex := NewExpander(bytes.NewReader(out.Bytes()), dict)
+		o, err := ex.Expand(make([]byte, 0))
+		assert(t, err == nil)
+		assert(t, bytes.Compare(o, input) == 0)
+	}
+	assert(t, refs[0] > 1)
+	assert(t, refs[1] == 1)
+	assert(t, refs[2] == 1)
+}
+
+func TestDictionaryStats(t *testing.T) {
+	st := (&Dictionary{}).Stats()
+	assert(t, st.Blocks == 0 && st.Fingerprints == 0 && st.Collisions == 0)
+
+	dict := randomBytes(10001, 33)
+	st = BuildDictionary(dict).Stats()
+	assert(t, st.Blocks == 200)
+	assert(t, st.Fingerprints == 200)
+	assert(t, st.Collisions == 0)
+	assert(t, st.Memory > int64(len(dict)))
+
+	// Half of the blocks repeat earlier ones
+
+	dict = append(dict[:5000], dict[:5000]...)
+	st = BuildDictionary(dict).Stats()
+	assert(t, st.Blocks == 199)
+	assert(t, st.Fingerprints == 100)
+	assert(t, st.Collisions > 0.49 && st.Collisions < 0.51)
+
+	wide := &Dictionary{Dict: dict, Wide: true}
+	wide.build(newRabinKarp(block), block)
+	assert(t, wide.Stats().Fingerprints == 100)
+	assert(t, wide.Stats().Memory > st.Memory)
+}
+
+func TestCollisionReport(t *testing.T) {
+	total, stored, dropped := (&Dictionary{}).CollisionReport()
+	assert(t, total == 0 && stored == 0 && dropped == 0)
+
+	// Random data only has collisions once there are enough blocks for
+	// fingerprints to be likely to repeat
+
+	dict := randomBytes(10001, 33)
+	total, stored, dropped = (&Dictionary{Dict: dict}).CollisionReport()
+	assert(t, total == 200 && stored == 200 && dropped == 0)
+
+	dict = randomBytes(10<<20, 108)
+	d := BuildDictionary(dict)
+	total, stored, dropped = d.CollisionReport()
+	assert(t, total == d.Stats().Blocks)
+	assert(t, stored == len(d.H))
+	assert(t, dropped == total-stored && dropped > 0)
+
+	// Blocks that repeat are dropped too, and the report is of Dict
+	// rather than the hash table so it doesn't depend on MaxEntries
+
+	dict = bytes.Repeat(dict[:100], 100)
+	total, stored, dropped = BuildDictionaryMax(dict, 1).CollisionReport()
+	assert(t, total == 199 && stored == 2 && dropped == 197)
+
+	d = &Dictionary{Dict: randomBytes(1000, 109), Stride: 10}
+	total, _, _ = d.CollisionReport()
+	assert(t, total == 95)
+	total, _, _ = BuildDictionaryBlock(d.Dict, 10).CollisionReport()
+	assert(t, total == 99)
+}
+
+func TestStride(t *testing.T) {
+	dict := randomBytes(10000, 34)
+
+	d := &Dictionary{Dict: dict, Stride: 10}
+	d.build(newRabinKarp(block), block)
+	assert(t, d.Stats().Blocks == 995)
+	assert(t, len(d.H) == 995)
+	for _, p := range d.H {
+		assert(t, p%10 == 0)
+	}
+
+	// A stride of the block size or more is the same as none
+
+	for _, stride := range []int{50, 100} {
+		d := &Dictionary{Dict: dict, Stride: stride}
+		d.build(newRabinKarp(block), block)
+		assert(t, len(d.H) == len(BuildDictionary(dict).H))
+	}
+
+	// Short pieces which are not aligned with the blocks of the
+	// dictionary are only found with a smaller stride
+
+	var input []byte
+	for o := 7; o+80 < len(dict); o += 997 {
+		input = append(input, dict[o:o+80]...)
+	}
+	sizes := []int{}
+	for _, stride := range []int{0, 10} {
+		b := new(bytes.Buffer)
+		co := NewCompressor()
+		co.SetWriter(b)
+		assert(t, co.SetDictionary(&Dictionary{Dict: dict, Stride: stride}) == nil)
+		co.Write(input)
+		assert(t, co.Close() == nil)
+		sizes = append(sizes, b.Len())
+
+		ex := NewExpander(bytes.NewReader(b.Bytes()), dict)
+		o, err := ex.Expand(make([]byte, 0))
+		assert(t, err == nil)
+		assert(t, bytes.Compare(o, input) == 0)
+	}
+	assert(t, sizes[1] < sizes[0]/4)
+}
+
+func TestDictionaryContext(t *testing.T) {
+	dict := randomBytes(20000, 36)
+	x, err := NewDictionaryContext(&Dictionary{Dict: dict})
+	assert(t, err == nil)
+
+	// Compressors from the context give the same output as ones given
+	// the dictionary with SetDictionary and can be used concurrently
+
+	var wg sync.WaitGroup
+	results := make([]bool, 16)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			input := append(randomBytes(100, int64(i)), dict[i*1000:i*1000+3000]...)
+
+			b := new(bytes.Buffer)
+			co := x.NewCompressor(b)
+			co.Write(input)
+			if co.Close() != nil {
+				return
+			}
+
+			b1 := new(bytes.Buffer)
+			co = NewCompressor()
+			co.SetWriter(b1)
+			co.SetDictionary(&Dictionary{Dict: dict})
+			co.Write(input)
+			if co.Close() != nil || !bytes.Equal(b.Bytes(), b1.Bytes()) {
+				return
+			}
+
+			o, err := x.NewExpander(b).Expand(make([]byte, 0))
+			results[i] = err == nil && bytes.Equal(o, input)
+		}(i)
+	}
+	wg.Wait()
+	for _, ok := range results {
+		assert(t, ok)
+	}
+
+	_, err = NewDictionaryContext(&Dictionary{Dict: dict[:10], H: BuildDictionary(dict).H})
+	assert(t, err != nil)
+}
+
+func TestClone(t *testing.T) {
+	dict := randomBytes(10000, 61)
+	wide := &Dictionary{Dict: dict, Wide: true}
+	wide.build(newRabinKarp(block), block)
+	for _, d := range []*Dictionary{
+		BuildDictionary(dict),
+		wide,
+		BuildDictionaryCandidates(bytes.Repeat(dict[:200], 10), 3),
+	} {
+		c := d.Clone()
+		assert(t, bytes.Equal(c.Dict, d.Dict))
+		assert(t, len(c.H) == len(d.H) && len(c.H64) == len(d.H64))
+		assert(t, len(c.Extra) == len(d.Extra))
+		assert(t, c.Wide == d.Wide && c.Candidates == d.Candidates)
+
+		// Modifying the clone leaves the original untouched
+
+		orig := append([]byte{}, d.Dict...)
+		fingerprints := len(d.H) + len(d.H64)
+		c.Dict[0] ^= 0xff
+		for f := range c.H {
+			delete(c.H, f)
+		}
+		for f := range c.H64 {
+			delete(c.H64, f)
+		}
+		for f := range c.Extra {
+			c.Extra[f][0] = 1 << 40
+		}
+		assert(t, bytes.Equal(d.Dict, orig))
+		assert(t, len(d.H)+len(d.H64) == fingerprints)
+		assert(t, d.check(block) == nil)
+	}
+
+	assert(t, (&Dictionary{}).Clone().H == nil)
+}
+
+func TestTrainDictionary(t *testing.T) {
+	r := rand.New(rand.NewSource(74))
+	var pieces [][]byte
+	for i := 0; i < 100; i++ {
+		pieces = append(pieces, randomBytes(150, int64(1000+i)))
+	}
+
+	// Each sample is made of common pieces with random data between
+	// them
+
+	samples := make([][]byte, 50)
+	for i := range samples {
+		for j := 0; j < 15; j++ {
+			samples[i] = append(samples[i], pieces[r.Intn(len(pieces))]...)
+			samples[i] = append(samples[i], randomBytes(r.Intn(50), int64(i*100+j))...)
+		}
+	}
+
+	d := TrainDictionary(samples[:40], 20000)
+	assert(t, len(d.Dict) > 0 && len(d.Dict) <= 20000)
+	assert(t, d.check(block) == nil)
+
+	// Held out samples compress much better with the dictionary than
+	// without one
+
+	with, without := 0, 0
+	for _, s := range samples[40:] {
+		b := new(bytes.Buffer)
+		_, err := Compress(b, s, d)
+		assert(t, err == nil)
+		with += b.Len()
+
+		o, err := Expand(nil, b, d.Dict)
+		assert(t, err == nil)
+		assert(t, bytes.Equal(o, s))
+
+		b.Reset()
+		_, err = Compress(b, s, nil)
+		assert(t, err == nil)
+		without += b.Len()
+	}
+	assert(t, with < without/2)
+
+	small := TrainDictionary(samples[:40], 1000)
+	assert(t, len(small.Dict) <= 1000)
+	assert(t, len(TrainDictionary(nil, 1000).Dict) == 0)
+}
+
+func TestMergeDictionaries(t *testing.T) {
+	for _, size := range []int{10000, 10025} {
+		a := BuildDictionary(randomBytes(size, 76))
+		b := &Dictionary{Dict: randomBytes(8000, 77)}
+		m := MergeDictionaries(a, b)
+		assert(t, len(m.Dict) == size+8000)
+		assert(t, m.check(block) == nil)
+		assert(t, b.H == nil)
+
+		// Data from either dictionary and data spanning the two
+		// compresses to one reference each
+
+		input := append([]byte{}, a.Dict[3000:5000]...)
+		input = append(input, '.')
+		input = append(input, b.Dict[1000:4000]...)
+		input = append(input, '.')
+		input = append(input, a.Dict[size-70:]...)
+		input = append(input, b.Dict[:500]...)
+
+		buf := new(bytes.Buffer)
+		co := NewCompressor()
+		co.SetWriter(buf)
+		assert(t, co.SetDictionary(m) == nil)
+		co.Write(input)
+		assert(t, co.Close() == nil)
+		refs, literals := co.Structure()
+		assert(t, refs == 3 && literals == 2)
+
+		o, err := Expand(nil, buf, m.Dict)
+		assert(t, err == nil)
+		assert(t, bytes.Equal(o, input))
+	}
+}
+
+func TestSecondary(t *testing.T) {
+	dict := randomBytes(1<<20, 105)
+	d := BuildDictionarySecondary(dict)
+	assert(t, len(d.H2) == len(d.H))
+	for f, p := range d.H {
+		assert(t, d.H2[f] == SecondaryEntry{uint64(p), secondary(dict[p : p+block])})
+	}
+	assert(t, d.Stats().Memory > BuildDictionary(dict).Stats().Memory)
+	c := d.Clone()
+	assert(t, len(c.H2) == len(d.H2))
+
+	// The output is the same with and without the secondary
+	// fingerprints, which only save comparing blocks known not to
+	// match
+
+	input := append(similar(dict[:100000]), randomBytes(200000, 106)...)
+	compress := func(d *Dictionary) ([]byte, uint64) {
+		co := NewCompressor()
+		co.SetDictionary(d)
+		o, err := co.CompressAppend(nil, input)
+		assert(t, err == nil)
+		_, fp := co.MatchStats()
+		return o, fp
+	}
+	want, wantFP := compress(BuildDictionary(dict))
+	o, fp := compress(d)
+	assert(t, bytes.Equal(o, want))
+	assert(t, fp == wantFP && fp > 0)
+
+	// Secondary fingerprints that differ from those of the blocks
+	// reject every match
+
+	for f, x := range d.H2 {
+		x.Sum++
+		d.H2[f] = x
+	}
+	o, _ = compress(d)
+	assert(t, len(o) > len(input))
+
+	// Set before the hash table is built by SetDictionary
+
+	co := NewCompressor()
+	co.SetDictionary(&Dictionary{Dict: dict, Secondary: true})
+	assert(t, len(co.GetDictionary().H2) == len(d.H))
+}
+
+func TestDictionaryBlockSize(t *testing.T) {
+	dict := randomBytes(10000, 107)
+
+	// A hash table of 40 byte blocks cannot be used by a Compressor
+	// fingerprinting 50 byte blocks
+
+	d := BuildDictionaryBlock(dict, 40)
+	assert(t, d.Block == 40)
+	co := NewCompressor()
+	assert(t, co.SetDictionary(d) != nil)
+	assert(t, len(co.GetDictionary().Dict) == 0)
+	_, err := NewDictionaryContext(d)
+	assert(t, err != nil)
+
+	// Without a hash table the block size doesn't matter as it is
+	// built for the Compressor's
+
+	assert(t, co.SetDictionary(&Dictionary{Dict: dict, Block: 40}) == nil)
+	assert(t, co.GetDictionary().Block == block)
+
+	for _, d := range []*Dictionary{
+		BuildDictionary(dict),
+		BuildDictionaryParallel(dict, 4),
+		MergeDictionaries(BuildDictionary(dict[:5000]), BuildDictionary(dict[5000:])),
+		BuildDictionaryBlock(dict, block),
+	} {
+		assert(t, d.Block == block)
+		assert(t, co.SetDictionary(d) == nil)
+	}
+
+	// Merging dictionaries built for another block size rebuilds their
+	// hash tables rather than mixing them into one of the wrong size
+
+	m := MergeDictionaries(BuildDictionaryBlock(dict[:5000], 40),
+		BuildDictionaryBlock(dict[5000:], 40))
+	assert(t, m.Block == block)
+	assert(t, len(m.H) == len(BuildDictionary(dict).H))
+	for f, p := range BuildDictionary(dict).H {
+		assert(t, m.H[f] == p)
+	}
+	assert(t, co.SetDictionary(m) == nil)
+
+	// The block size of a hash table made by hand is not known
+
+	assert(t, co.SetDictionary(&Dictionary{Dict: dict, H: d.H}) == nil)
+}
+
+func TestEvaluate(t *testing.T) {
+	dict := randomBytes(100000, 115)
+	r := rand.New(rand.NewSource(116))
+
+	// Samples taken from the dictionary with some changes, and the
+	// same number of unrelated ones
+
+	var samples, unrelated [][]byte
+	for k := 0; k < 20; k++ {
+		o := r.Intn(len(dict) - 5000)
+		samples = append(samples, similar(dict[o:o+1000+r.Intn(4000)]))
+		unrelated = append(unrelated, randomBytes(1000+r.Intn(4000), int64(k)))
+	}
+
+	d := BuildDictionary(dict)
+	avg, in, out := d.Evaluate(samples)
+	want := 0
+	for _, s := range samples {
+		want += len(s)
+	}
+	assert(t, in == want)
+	assert(t, avg == ratio(out, in) && avg < 2000)
+
+	// Each sample compressed alone gives the same total
+
+	total := 0
+	for _, s := range samples {
+		b := new(bytes.Buffer)
+		_, err := Compress(b, s, d)
+		assert(t, err == nil)
+		total += b.Len()
+	}
+	assert(t, out == total)
+
+	// A dictionary the samples weren't taken from does worse
+
+	other, _, _ := BuildDictionary(randomBytes(100000, 117)).Evaluate(samples)
+	assert(t, other > avg)
+	worse, _, _ := d.Evaluate(unrelated)
+	assert(t, worse > 10000)
+	avg, _, _ = d.Evaluate(append(samples, unrelated...))
+	assert(t, avg > 2000 && avg < worse)
+
+	// Without samples or with a dictionary that can't be used
+
+	avg, in, out = d.Evaluate(nil)
+	assert(t, avg == -1 && in == 0 && out == 0)
+	avg, _, _ = BuildDictionaryBlock(dict, 40).Evaluate(samples)
+	assert(t, avg == -1)
+}
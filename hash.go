@@ -0,0 +1,103 @@
+// hash.go: the rolling hash used to fingerprint blocks
+//
+// Copyright (c) 2012-2013 CloudFlare, Inc.
+
+package bm
+
+// A RollingHash computes the fingerprint of a window of block bytes
+// which slides over the data one byte at a time.  The default
+// implementation is the Rabin/Karp fingerprint described at the top
+// of bm.go; an alternative can be passed to NewCompressorWithHash
+// for experimentation.
+type RollingHash interface {
+	Reset()            // Clears the fingerprint before a new pass
+	Prime(b byte)      // Adds b to the window while it is being filled
+	Roll(out, in byte) // Slides the window removing out and adding in
+	Sum() uint32       // Returns the fingerprint of the current window
+}
+
+// rabinKarp is the default RollingHash
+type rabinKarp struct {
+	f uint32 // The current fingerprint
+	l uint32 // Largest 'digit' in the radix that will be seen in the
+	// fingerprint
+	save *[256]uint32 // Multiples of l, never modified so can be shared
+}
+
+// The tables for the default block size are calculated once and
+// shared by every rabinKarp for that size so that creating a
+// Compressor is cheap
+var defaultL, defaultSave = tables(block)
+
+// newRabinKarp creates a Rabin/Karp rolling hash for blocks of size
+// bytes
+func newRabinKarp(size uint32) *rabinKarp {
+	h := rabinKarp{}
+	if size == block {
+		h.l, h.save = defaultL, defaultSave
+	} else {
+		h.l, h.save = tables(size)
+	}
+	return &h
+}
+
+// tables calculates the largest 'digit' that can be stored in the
+// fingerprint of a block of size bytes, and the multiples of it for
+// every possible byte value.
+func tables(size uint32) (l uint32, save *[256]uint32) {
+
+	// The largest digit is radix^(size-1) mod prime.  Calculated in a
+	// loop to avoid an overflow when doing something like 256^100 mod
+	// 16777213.
+
+	l = 1
+	save = new([256]uint32)
+	var i uint32
+	for i = 0; i < size-1; i++ {
+		l *= radix
+		l &= clip
+	}
+
+	for i = 0; i < 256; i++ {
+		save[i] = i * l
+	}
+
+	return
+}
+
+func (h *rabinKarp) Reset() {
+	h.f = 0
+}
+
+func (h *rabinKarp) Prime(b byte) {
+	h.f = (h.f*radix + uint32(b)) & clip
+}
+
+// Roll calculates the fingerprint of the next block efficiently.  The
+// canonical calculation is as follows:
+//
+// f = ( radix * ( f - out * l ) + in ) % prime
+//
+// But a number of tricks are performed to make this faster. First,
+// values of out * l are kept in an array so they are only calculated
+// once. Second, the modulo calculation is done using bit twiddling
+// rather than division.
+func (h *rabinKarp) Roll(out, in byte) {
+	h.f = ((h.f-h.save[out])*radix + uint32(in)) & clip
+}
+
+func (h *rabinKarp) Sum() uint32 {
+	return h.f
+}
+
+// secondary returns a fingerprint of p (FNV-1a) that is independent of
+// the rolling hash, used to rule out false positives cheaply (see
+// Dictionary.Secondary)
+func secondary(p []byte) uint32 {
+	s := uint32(2166136261)
+	for _, b := range p {
+		s ^= uint32(b)
+		s *= 16777619
+	}
+	return s
+}
@@ -0,0 +1,136 @@
+// hash_test.go: tests for the rolling hash
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package bm
+
+import (
+	"bytes"
+	"testing"
+)
+
+// sumHash is a trivial RollingHash which is the sum of the bytes in
+// the window
+type sumHash struct {
+	sum uint32
+}
+
+func (h *sumHash) Reset()            { h.sum = 0 }
+func (h *sumHash) Prime(b byte)      { h.sum += uint32(b) }
+func (h *sumHash) Roll(out, in byte) { h.sum += uint32(in) - uint32(out) }
+func (h *sumHash) Sum() uint32       { return h.sum }
+
+func TestRabinKarp(t *testing.T) {
+	data := randomBytes(1000, 7)
+	h := newRabinKarp(block)
+	for i := 0; i < len(data); i++ {
+		if i < int(block) {
+			h.Prime(data[i])
+			continue
+		}
+
+		// The rolled fingerprint must equal the fingerprint computed
+		// from scratch over the same window
+
+		f := h.Sum()
+		g := newRabinKarp(block)
+		for _, b := range data[i-int(block) : i] {
+			g.Prime(b)
+		}
+		assert(t, f == g.Sum())
+
+		h.Roll(data[i-int(block)], data[i])
+	}
+}
+
+func TestSharedTables(t *testing.T) {
+
+	// The tables for the default block size are shared, others are
+	// calculated for the size
+
+	a, b := newRabinKarp(block), newRabinKarp(block)
+	assert(t, a.save == b.save && a.save == defaultSave)
+	assert(t, a.l == defaultL)
+	l, save := tables(block)
+	assert(t, l == defaultL && *save == *defaultSave)
+
+	c := newRabinKarp(10)
+	l, save = tables(10)
+	assert(t, c.save != defaultSave)
+	assert(t, c.l == l && *c.save == *save)
+
+	// Using a hash must not change the shared tables
+
+	for _, x := range randomBytes(1000, 9) {
+		a.Roll(x, x^0xff)
+	}
+	_, save = tables(block)
+	assert(t, *defaultSave == *save)
+}
+
+func TestAlternateHash(t *testing.T) {
+	s := []byte("the quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dogthe quick brown fox jumps over the lazy dog")
+	dict := append(randomBytes(2000, 8), s...)
+	s1 := string(s)
+	input := []byte("THE" + s1 + "HELLO JOHN" + s1 + "DOG")
+
+	for _, d := range [][]byte{dict, nil} {
+		b := new(bytes.Buffer)
+		co := NewCompressorWithHash(&sumHash{})
+		co.SetWriter(b)
+		co.SetDictionary(&Dictionary{Dict: d})
+		co.Write(input)
+		assert(t, co.Close() == nil)
+		assert(t, b.Len() < len(input))
+		hits, _ := co.MatchStats()
+		assert(t, hits > 0)
+
+		ex := NewExpander(b, d)
+		o, err := ex.Expand(make([]byte, 0))
+		assert(t, err == nil)
+		assert(t, bytes.Compare(o, input) == 0)
+	}
+}
+
+func TestFingerprintConsistency(t *testing.T) {
+	inputs := [][]byte{
+		bytes.Repeat([]byte{0xff}, 5000),
+		bytes.Repeat([]byte{0}, 5000),
+		bytes.Repeat([]byte{0xff, 0}, 2500),
+		bytes.Repeat([]byte{0xfe, 0xff, 0xff, 0x01}, 1250),
+	}
+	for seed := int64(100); seed < 120; seed++ {
+		inputs = append(inputs, randomBytes(5000+int(seed), seed))
+	}
+
+	for _, data := range inputs {
+
+		// Every block stored when the dictionary is built must have
+		// the fingerprint it was stored under when computed from
+		// scratch
+
+		d := BuildDictionary(data)
+		for f, p := range d.H {
+			g := newRabinKarp(block)
+			for _, b := range data[p : p+block] {
+				g.Prime(b)
+			}
+			assert(t, g.Sum() == f)
+		}
+
+		// Compressing the dictionary against itself must then find
+		// the block boundaries without any collisions
+
+		b := new(bytes.Buffer)
+		co := NewCompressor()
+		co.SetWriter(b)
+		co.SetDictionary(d)
+		co.Write(data)
+		assert(t, co.Close() == nil)
+		hits, falsePositives := co.MatchStats()
+		assert(t, hits > 0)
+		assert(t, falsePositives == 0)
+		refs, _ := co.Structure()
+		assert(t, refs == 1)
+	}
+}
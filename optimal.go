@@ -0,0 +1,226 @@
+// optimal.go: the smallest stream that data can be compressed into
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package bm
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// OptimalSize returns the size of the smallest stream that data can be
+// compressed into against d, for measuring how far the output of Close
+// is from the best possible.  Every match that the hash table of d
+// leads to is found, from every position of data rather than only
+// where Close looks, and the cheapest way of covering data with
+// uncompressed sections and references to any part of those matches
+// is found by dynamic programming using the exact sizes of the section
+// headers.  Matches that the hash table cannot find (because the block
+// they share with the dictionary isn't in it) are not considered, nor
+// are references to earlier parts of data, so this is not meaningful
+// without a dictionary.  Control sections are not counted.  This is
+// much slower than compressing and uses memory proportional to the
+// length of data.  If the hash table of d has not been built it is
+// built here (without modifying d).
+func OptimalSize(data []byte, d *Dictionary) int {
+	if d.H == nil && d.H64 == nil {
+		b := *d
+		b.build(newRabinKarp(block), block)
+		d = &b
+	}
+	matches := optimalMatches(data, d)
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].start < matches[j].start
+	})
+
+	// best[i] is the smallest size data[:i] can be written in.  Each
+	// way of reaching i is a section starting at some x < i, the size
+	// of whose header depends on its length i-x, so the candidates
+	// for x are kept in a window for each size of length varint.
+
+	n := len(data)
+	best := make([]int, n+1)
+	literal := func(x int) int { return best[x] - x }
+	literals := optimalWindows(n)
+
+	var active []*optimalMatch
+	next := 0
+	for i := 1; i <= n; i++ {
+		b := maxInt
+		for _, w := range literals {
+			if x := w.min(i, 0, literal); x >= 0 {
+				if c := literal(x) + i + w.size; c < b {
+					b = c
+				}
+			}
+		}
+
+		// A reference to any part of a match that covers i can end
+		// there
+
+		for ; next < len(matches) && matches[next].start < i; next++ {
+			m := &matches[next]
+			m.windows = optimalWindows(m.end - m.start)
+			m.cost = func(x int) int {
+				return best[x] + 1 + uvarintLen(m.offset+uint64(x-m.start))
+			}
+			active = append(active, m)
+		}
+		kept := active[:0]
+		for _, m := range active {
+			if m.end < i {
+				continue
+			}
+			kept = append(kept, m)
+			for _, w := range m.windows {
+				if x := w.min(i, m.start, m.cost); x >= 0 {
+					if c := m.cost(x) + w.size; c < b {
+						b = c
+					}
+				}
+			}
+		}
+		active = kept
+
+		best[i] = b
+	}
+
+	return best[n]
+}
+
+// An optimalMatch is a part of the data, data[start:end], which is
+// the same as the part of the dictionary starting at offset.  While
+// references to it are being considered cost gives the size of the
+// data before x plus that of a reference starting at x, without its
+// length varint.
+type optimalMatch struct {
+	start, end int
+	offset     uint64
+	windows    []*optimalWindow
+	cost       func(x int) int
+}
+
+// optimalMatches finds every match between data and the dictionary
+// that the hash table leads to, extended as far as possible in both
+// directions
+func optimalMatches(data []byte, d *Dictionary) []optimalMatch {
+	blk := uint64(block)
+	n := uint64(len(data))
+	if n < blk || len(d.Dict) == 0 {
+		return nil
+	}
+
+	// The blocks of a match after its first lead to the same match,
+	// which is recognized by the difference between its position in
+	// the dictionary and in the data
+
+	var matches []optimalMatch
+	ends := make(map[uint64]uint64)
+	found := func(e, p uint64) {
+		diagonal := e - p
+		if end, ok := ends[diagonal]; ok && p+blk <= end {
+			return
+		}
+		if e > uint64(len(d.Dict)) || blk > uint64(len(d.Dict))-e {
+			return
+		}
+		for j := uint64(0); j < blk; j++ {
+			if d.Dict[e+j] != data[p+j] {
+				return
+			}
+		}
+
+		s := uint64(0)
+		for s < p && s < e && d.Dict[e-s-1] == data[p-s-1] {
+			s++
+		}
+		f := uint64(0)
+		for p+blk+f < n && e+blk+f < uint64(len(d.Dict)) && d.Dict[e+blk+f] == data[p+blk+f] {
+			f++
+		}
+		ends[diagonal] = p + blk + f
+		matches = append(matches, optimalMatch{
+			start:  int(p - s),
+			end:    int(p + blk + f),
+			offset: e - s,
+		})
+	}
+
+	h := newRabinKarp(block)
+	for i := uint64(0); i <= n; i++ {
+		if i < blk {
+			h.Prime(data[i])
+			continue
+		}
+		sum := h.Sum()
+		if e, ok := d.lookup(sum); ok {
+			found(e, i-blk)
+		}
+		for _, e := range d.Extra[sum] {
+			found(e, i-blk)
+		}
+		if i < n {
+			h.Roll(data[i-blk], data[i])
+		}
+	}
+	return matches
+}
+
+// An optimalWindow holds the positions x from which a section of
+// length between lo and hi can end at the current position i, in
+// increasing order of cost (a monotonic queue), so that the cheapest
+// is found without looking at every x.  The length varint of those
+// sections is size bytes long.
+type optimalWindow struct {
+	lo, hi int
+	size   int
+	next   int   // Next position to be added
+	xs     []int // Positions in the window, cheapest first
+}
+
+// optimalWindows returns a window for each size of varint needed for
+// lengths up to n
+func optimalWindows(n int) []*optimalWindow {
+	var ws []*optimalWindow
+	lo := 1
+	for size := 1; lo <= n; size++ {
+		hi := maxInt
+		if size < 9 {
+			hi = 1<<(7*uint(size)) - 1
+		}
+		ws = append(ws, &optimalWindow{lo: lo, hi: hi, size: size})
+		if hi == maxInt {
+			break
+		}
+		lo = hi + 1
+	}
+	return ws
+}
+
+// min moves the window to i, where sections can start no earlier than
+// first, and returns the cheapest x (or -1 if the window is empty)
+func (w *optimalWindow) min(i, first int, cost func(x int) int) int {
+	if w.next < first {
+		w.next = first
+	}
+	for ; w.next <= i-w.lo; w.next++ {
+		c := cost(w.next)
+		for len(w.xs) > 0 && cost(w.xs[len(w.xs)-1]) >= c {
+			w.xs = w.xs[:len(w.xs)-1]
+		}
+		w.xs = append(w.xs, w.next)
+	}
+	for len(w.xs) > 0 && w.xs[0] < i-w.hi {
+		w.xs = w.xs[1:]
+	}
+	if len(w.xs) == 0 {
+		return -1
+	}
+	return w.xs[0]
+}
+
+// uvarintLen returns the number of bytes in the varint encoding of u
+func uvarintLen(u uint64) int {
+	return (bits.Len64(u|1) + 6) / 7
+}
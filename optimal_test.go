@@ -0,0 +1,96 @@
+// optimal_test.go: tests for the optimal compressed size
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package bm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// slowOptimalSize is OptimalSize without the windows, trying every
+// start for every section
+func slowOptimalSize(data []byte, d *Dictionary) int {
+	matches := optimalMatches(data, d)
+	best := make([]int, len(data)+1)
+	for i := 1; i <= len(data); i++ {
+		best[i] = maxInt
+		for x := 0; x < i; x++ {
+			if c := best[x] + uvarintLen(uint64(i-x)) + i - x; c < best[i] {
+				best[i] = c
+			}
+		}
+		for _, m := range matches {
+			for x := m.start; x < i && i <= m.end; x++ {
+				c := best[x] + 1 + uvarintLen(m.offset+uint64(x-m.start)) + uvarintLen(uint64(i-x))
+				if c < best[i] {
+					best[i] = c
+				}
+			}
+		}
+	}
+	return best[len(data)]
+}
+
+func TestOptimalSize(t *testing.T) {
+	for _, u := range []uint64{0, 1, 127, 128, 16383, 16384, 1<<63 - 1, 1 << 63} {
+		assert(t, uvarintLen(u) == binary.PutUvarint(make([]byte, 10), u))
+	}
+
+	dict := randomBytes(20000, 88)
+	d := BuildDictionary(dict)
+
+	// No matches leaves one uncompressed section and the whole
+	// dictionary is one reference
+
+	random := randomBytes(1000, 89)
+	assert(t, OptimalSize(random, d) == 2+len(random))
+	assert(t, OptimalSize(dict, d) == 1+1+3)
+	assert(t, OptimalSize(nil, d) == 0)
+
+	inputs := [][]byte{
+		similar(dict),
+		append(append(randomBytes(3000, 90), dict[777:9999]...), random...),
+		append(append([]byte{}, dict[1000:1400]...), dict[1100:1500]...),
+		similar(dict[5000:8000]),
+	}
+	for _, input := range inputs {
+		b := new(bytes.Buffer)
+		co := NewCompressor()
+		co.SetWriter(b)
+		co.SetDictionary(d)
+		co.Write(input)
+		assert(t, co.Close() == nil)
+		optimal := OptimalSize(input, d)
+		assert(t, optimal <= b.Len())
+		assert(t, optimal > 0)
+		if len(input) <= 5000 {
+			assert(t, optimal == slowOptimalSize(input, d))
+		}
+	}
+
+	// When the hash table only leads to the copy of a that is not
+	// followed by b, Close writes two references where one would do
+
+	a, b := randomBytes(1000, 91), randomBytes(1000, 92)
+	dict = append(append([]byte{}, a...), randomBytes(1000, 93)...)
+	dict = append(append(dict, a...), b...)
+	input := append(append([]byte{}, a...), b...)
+	d = BuildDictionary(dict)
+	out := new(bytes.Buffer)
+	co := NewCompressor()
+	co.SetWriter(out)
+	co.SetDictionary(d)
+	co.Write(input)
+	assert(t, co.Close() == nil)
+	refs, _ := co.Structure()
+	assert(t, refs == 2)
+	assert(t, OptimalSize(input, d) == 1+2+2)
+	assert(t, out.Len() > 1+2+2)
+
+	// The hash table is built if needed
+
+	assert(t, OptimalSize(input, &Dictionary{Dict: dict}) == OptimalSize(input, d))
+}
@@ -0,0 +1,237 @@
+// state.go: saving and restoring the state of a Compressor part way
+// through a stream
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package bm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// State format:
+//
+// stateMagic and stateVersion followed by a byte of flags and then
+// the varints listed in state, the buffered data (preceded by its
+// length) and, if the input is being kept for references to it, its
+// hash table as a count followed by fingerprint and position pairs.
+// When the hash table is limited to the window the order in which
+// fingerprints were added and the position of the oldest follow.
+
+const (
+	stateMagic   = "BMS"
+	stateVersion = 1
+)
+
+const (
+	stateStarted = 1 << iota // The start of the stream has been written
+	stateLocal               // The hash table of the input follows
+	stateLimited             // The hash table is limited to the window
+)
+
+// state returns pointers to the numbers saved by State in the order
+// they are written
+func (c *Compressor) state(f *uint64) []*uint64 {
+	return []*uint64{
+		f, &c.window, &c.start, &c.i, &c.skip, &c.last, &c.base,
+		&c.summed, &c.pos, &c.prev, &c.hits, &c.falsePositives,
+	}
+}
+
+// State returns the state of a Compressor part way through a stream,
+// for example one being compressed with SetWindow, so that compression
+// can be resumed with RestoreState after a restart.  Everything needed
+// to continue the stream is included (the data buffered, the rolling
+// hash and, without a dictionary, the hash table of the input) except
+// the dictionary and the options, which must be set again in the same
+// way before restoring.  The output written so far is not included and
+// the output of the resumed Compressor follows it.  The numbers of
+// references and literals of each length (see LengthHistograms) start
+// again from zero.  An error is returned if the Compressor uses a
+// RollingHash other than the default, which cannot be saved, or while
+// data is spilled to a file (see SetSpill).
+func (c *Compressor) State() ([]byte, error) {
+	if c.closed {
+		return nil, ErrClosed
+	}
+	h, ok := c.h.(*rabinKarp)
+	if !ok {
+		return nil, errors.New("the state of a custom rolling hash cannot be saved")
+	}
+	if c.spilled != nil {
+		return nil, errors.New("cannot save the state while input is spilled")
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(stateMagic)
+	buf.WriteByte(stateVersion)
+
+	var flags byte
+	if c.started {
+		flags |= stateStarted
+	}
+	if c.local != nil {
+		flags |= stateLocal
+	}
+	if c.lh != nil {
+		flags |= stateLimited
+	}
+	buf.WriteByte(flags)
+
+	var scratch [binary.MaxVarintLen64]byte
+	put := func(u uint64) {
+		buf.Write(scratch[:binary.PutUvarint(scratch[:], u)])
+	}
+
+	f := uint64(h.f)
+	for _, u := range c.state(&f) {
+		put(*u)
+	}
+	for _, n := range []int{c.inSize, c.outSize, c.references, c.literals} {
+		put(uint64(n))
+	}
+	put(uint64(c.crc))
+	put(uint64(len(c.d)))
+	buf.Write(c.d)
+
+	if c.local != nil {
+		put(uint64(len(c.local.H) + len(c.local.H64)))
+		for k, v := range c.local.H {
+			put(uint64(k))
+			put(uint64(v))
+		}
+		for k, v := range c.local.H64 {
+			put(uint64(k))
+			put(v)
+		}
+	}
+	if c.lh != nil {
+		put(uint64(len(c.lh.order)))
+		for _, k := range c.lh.order {
+			put(uint64(k))
+		}
+		put(uint64(c.lh.oldest))
+	}
+
+	return buf.Bytes(), nil
+}
+
+// ErrCorruptState is returned by RestoreState if the state is not one
+// returned by State
+var ErrCorruptState = errors.New("corrupt compressor state")
+
+// RestoreState resumes compression from the state s returned by State.
+// The Compressor must have been Reset (or just created) and given its
+// writer, dictionary and options as the one the state was saved from
+// was; an error is returned if the window is not the same.  Nothing is
+// changed if an error is returned.
+func (c *Compressor) RestoreState(s []byte) error {
+	h, ok := c.h.(*rabinKarp)
+	if !ok {
+		return errors.New("the state of a custom rolling hash cannot be restored")
+	}
+	if c.started || len(c.d) > 0 || c.closed {
+		return errors.New("state must be restored before any data is written")
+	}
+
+	if len(s) < len(stateMagic)+2 || string(s[:len(stateMagic)]) != stateMagic {
+		return ErrCorruptState
+	}
+	if v := s[len(stateMagic)]; v != stateVersion {
+		return fmt.Errorf("unsupported compressor state version %d", v)
+	}
+	flags := s[len(stateMagic)+1]
+	r := bytes.NewReader(s[len(stateMagic)+2:])
+
+	var err error
+	get := func() uint64 {
+		if err != nil {
+			return 0
+		}
+		var u uint64
+		if u, err = binary.ReadUvarint(r); err != nil {
+			err = fmt.Errorf("%w: %v", ErrCorruptState, err)
+		}
+		return u
+	}
+
+	// Everything is read into a copy which replaces c only if the
+	// whole state is valid
+
+	n := *c
+	var f uint64
+	for _, u := range n.state(&f) {
+		*u = get()
+	}
+	for _, p := range []*int{&n.inSize, &n.outSize, &n.references, &n.literals} {
+		*p = int(get())
+	}
+	n.crc = uint32(get())
+	size := get()
+	if err == nil && size > uint64(r.Len()) {
+		return ErrCorruptState
+	}
+	n.d = append(c.d[:0], make([]byte, size)...)
+	if err == nil {
+		io.ReadFull(r, n.d)
+	}
+
+	n.local, n.lh = nil, nil
+	if flags&stateLocal != 0 {
+		n.local = &Dictionary{}
+		entries := get()
+		wide := false
+		pairs := make([][2]uint64, 0)
+		for k := uint64(0); k < entries && err == nil; k++ {
+			pair := [2]uint64{get(), get()}
+			wide = wide || pair[1] > maxNarrow
+			pairs = append(pairs, pair)
+		}
+		if wide {
+			n.local.Wide = true
+			n.local.H64 = make(map[uint32]uint64, len(pairs))
+		} else {
+			n.local.H = make(map[uint32]uint32, len(pairs))
+		}
+		for _, p := range pairs {
+			n.local.add(uint32(p[0]), p[1])
+		}
+	}
+	if flags&stateLimited != 0 && n.local != nil {
+		n.local.MaxEntries = int(n.window/uint64(block)) + 1
+		n.lh = &hasher{d: n.local}
+		count := get()
+		for k := uint64(0); k < count && err == nil; k++ {
+			n.lh.order = append(n.lh.order, uint32(get()))
+		}
+		n.lh.oldest = int(get())
+	}
+
+	if err != nil {
+		return err
+	}
+	l := uint64(len(n.d))
+	if r.Len() != 0 || n.window != c.window || n.i > l || n.last > l ||
+		n.start > l || n.summed > l {
+		return ErrCorruptState
+	}
+
+	// The oldest fingerprint must be in the ring, which can't hold more
+	// than the hash table, or adding to it would index outside it
+
+	if n.lh != nil {
+		if o := len(n.lh.order); o > n.local.MaxEntries ||
+			n.lh.oldest < 0 || (o == 0 && n.lh.oldest != 0) || (o > 0 && n.lh.oldest >= o) {
+			return ErrCorruptState
+		}
+	}
+
+	n.started = flags&stateStarted != 0
+	*c = n
+	h.f = uint32(f)
+	return nil
+}
@@ -0,0 +1,115 @@
+// state_test.go: tests for saving and restoring a Compressor
+//
+// Copyright (c) 2013 CloudFlare, Inc.
+
+package bm
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestState(t *testing.T) {
+	dict := randomBytes(100000, 99)
+	input := similar(dict)
+	input = append(input, randomBytes(20000, 100)...)
+	input = append(input, input[95000:115000]...)
+
+	type setup func(co *Compressor)
+	setups := []setup{
+		func(co *Compressor) { co.SetWindow(30000) },
+		func(co *Compressor) { co.SetWindow(30000); co.SetChecksum(true); co.SetDeltaOffsets(true) },
+		func(co *Compressor) { co.SetWindow(1 << 20); co.SetSelfReferences(true) },
+		func(co *Compressor) {},
+	}
+
+	for _, d := range [][]byte{dict, nil} {
+		for _, s := range setups {
+			compressor := func(w *bytes.Buffer) *Compressor {
+				co := NewCompressor()
+				co.SetWriter(w)
+				co.SetDictionary(&Dictionary{Dict: d})
+				s(co)
+				return co
+			}
+
+			whole := new(bytes.Buffer)
+			co := compressor(whole)
+			co.Write(input)
+			assert(t, co.Close() == nil)
+			ratio := co.Ratio()
+
+			// Stopping and carrying on with a new Compressor gives
+			// the same output, wherever the stream is stopped
+
+			for _, at := range []int{0, 1, 10000, 60123, len(input)} {
+				b := new(bytes.Buffer)
+				co := compressor(b)
+				co.Write(input[:at])
+				state, err := co.State()
+				assert(t, err == nil)
+
+				resumed := compressor(b)
+				assert(t, resumed.RestoreState(state) == nil)
+				resumed.Write(input[at:])
+				assert(t, resumed.Close() == nil)
+				assert(t, bytes.Equal(b.Bytes(), whole.Bytes()))
+				assert(t, resumed.CompressedSize() == b.Len())
+				assert(t, resumed.Ratio() == ratio)
+			}
+		}
+	}
+
+	// The options must match and the state must be intact
+
+	co := NewCompressor()
+	co.SetWriter(new(bytes.Buffer))
+	co.SetWindow(1000)
+	co.Write(input[:5000])
+	state, err := co.State()
+	assert(t, err == nil)
+
+	other := NewCompressor()
+	other.SetWriter(new(bytes.Buffer))
+	assert(t, other.RestoreState(state) != nil)
+	other.SetWindow(1000)
+	for i := 0; i < len(state); i++ {
+		err := other.RestoreState(state[:i])
+		assert(t, errors.Is(err, ErrCorruptState))
+	}
+	assert(t, other.RestoreState(append(state, 0)) == ErrCorruptState)
+	assert(t, other.BufferedBytes() == 0)
+	assert(t, other.RestoreState(state) == nil)
+	assert(t, other.RestoreState(state) != nil)
+
+	// A ring of fingerprints which adding to would index outside of is
+	// rejected
+
+	co = NewCompressor()
+	co.SetWriter(new(bytes.Buffer))
+	co.SetWindow(1000)
+	co.Write(input)
+	assert(t, len(co.lh.order) == co.local.MaxEntries)
+	for _, bad := range []func(h *hasher){
+		func(h *hasher) { h.oldest = len(h.order) },
+		func(h *hasher) { h.order = append(h.order, 1) },
+		func(h *hasher) { h.order, h.oldest = nil, 1 },
+	} {
+		saved := *co.lh
+		bad(co.lh)
+		state, err := co.State()
+		*co.lh = saved
+		assert(t, err == nil)
+		other := NewCompressor()
+		other.SetWriter(new(bytes.Buffer))
+		other.SetWindow(1000)
+		assert(t, other.RestoreState(state) == ErrCorruptState)
+	}
+
+	// A custom hash can't be saved
+
+	co = NewCompressorWithHash(&sumHash{})
+	_, err = co.State()
+	assert(t, err != nil)
+}